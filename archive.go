@@ -0,0 +1,99 @@
+package gittp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+)
+
+// ArchiveFormat is a format git archive can write a snapshot of a commit in
+type ArchiveFormat string
+
+const (
+	// ArchiveTar is an uncompressed tarball
+	ArchiveTar ArchiveFormat = "tar"
+	// ArchiveTarGz is a gzip compressed tarball
+	ArchiveTarGz ArchiveFormat = "tar.gz"
+	// ArchiveZip is a zip file
+	ArchiveZip ArchiveFormat = "zip"
+)
+
+// archiveReader streams the output of git archive. The process is not started until the first Read.
+type archiveReader struct {
+	ctx          context.Context
+	fullRepoPath string
+	hash         string
+	format       ArchiveFormat
+	cmd          *exec.Cmd
+	stdout       io.ReadCloser
+	done         bool
+	err          error
+}
+
+func newArchiveReader(ctx context.Context, fullRepoPath, hash string, format ArchiveFormat) *archiveReader {
+	return &archiveReader{ctx: ctx, fullRepoPath: fullRepoPath, hash: hash, format: format}
+}
+
+// start runs git archive, only keeping hold of the process once it has started so that Close never has to stop one that isn't there
+func (a *archiveReader) start() error {
+	cmd := exec.CommandContext(a.ctx, "git", "archive", "--format="+string(a.format), a.hash)
+	cmd.Dir = a.fullRepoPath
+	cmd.Stderr = os.Stdout
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	a.cmd, a.stdout = cmd, stdout
+	return nil
+}
+
+func (a *archiveReader) Read(p []byte) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+
+	if a.cmd == nil {
+		if err := a.start(); err != nil {
+			a.err = errCouldNotGetArchive
+			return 0, a.err
+		}
+	}
+
+	n, err := a.stdout.Read(p)
+	if err == io.EOF && !a.done {
+		a.done = true
+		if werr := a.cmd.Wait(); werr != nil {
+			a.err = errCouldNotGetArchive
+			return n, a.err
+		}
+	}
+
+	return n, err
+}
+
+// Close stops git archive if the archive was not read to the end
+func (a *archiveReader) Close() error {
+	if a.cmd == nil || a.done {
+		return nil
+	}
+
+	a.done = true
+	a.cmd.Process.Kill()
+	a.cmd.Wait()
+	return nil
+}
+
+func gitArchive(ctx context.Context, fullRepoPath, hash string) ([]byte, error) {
+	archive := newArchiveReader(ctx, fullRepoPath, hash, ArchiveTar)
+	defer archive.Close()
+
+	return ioutil.ReadAll(archive)
+}
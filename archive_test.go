@@ -0,0 +1,122 @@
+package gittp
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createTestRepo makes a bare repository with a single commit of README.md on master, returning its path and the commit hash
+func createTestRepo(t *testing.T) (string, string) {
+	dir, err := ioutil.TempDir("", "gittp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	work, repo := filepath.Join(dir, "work"), filepath.Join(dir, "repo.git")
+	ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("# test\n"), 0644)
+
+	runGit(t, dir, "init", "-q", "--bare", repo)
+	runGit(t, dir, "init", "-q", work)
+	os.Rename(filepath.Join(dir, "README.md"), filepath.Join(work, "README.md"))
+	runGit(t, work, "add", "README.md")
+	runGit(t, work, "commit", "-q", "-m", "initial commit")
+	runGit(t, work, "push", "-q", repo, "HEAD:refs/heads/master")
+
+	return repo, runGit(t, work, "rev-parse", "HEAD")
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	cmd := exec.Command("git", append([]string{"-c", "user.name=gittp", "-c", "user.email=gittp@example.com"}, args...)...)
+	cmd.Dir = dir
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, output)
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+func Test_HookContext_Archive(t *testing.T) {
+	repo, commit := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	h := &HookContext{FullRepoPath: repo, Commit: commit}
+
+	unread := h.Archive(ArchiveTar)
+	if unread.(*archiveReader).cmd != nil {
+		t.Error("expected git archive not to start before the archive is read")
+	}
+	unread.Close()
+
+	archive := h.Archive(ArchiveTarGz)
+	defer archive.Close()
+
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr := tar.NewReader(gz)
+	found := false
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		found = found || header.Name == "README.md"
+	}
+
+	if !found {
+		t.Error("expected README.md in the tar.gz archive")
+	}
+
+	zipped, err := ioutil.ReadAll(h.Archive(ArchiveZip))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(zipped), int64(len(zipped)))
+	if err != nil || len(zr.File) != 1 || zr.File[0].Name != "README.md" {
+		t.Errorf("expected a zip archive holding README.md - actual %v", err)
+	}
+
+	if _, err := ioutil.ReadAll((&HookContext{FullRepoPath: repo, Commit: "refs/heads/missing"}).Archive(ArchiveTar)); err != errCouldNotGetArchive {
+		t.Errorf("expected %v - actual %v", errCouldNotGetArchive, err)
+	}
+}
+
+func Test_gitArchive_cancelled(t *testing.T) {
+	repo, commit := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// git archive never starts, which Close must cope with
+	if _, err := gitArchive(ctx, repo, commit); err != errCouldNotGetArchive {
+		t.Errorf("expected %v - actual %v", errCouldNotGetArchive, err)
+	}
+
+	archive := newArchiveReader(ctx, repo, commit, ArchiveTar)
+	if _, err := archive.Read(make([]byte, 512)); err != errCouldNotGetArchive {
+		t.Errorf("expected %v - actual %v", errCouldNotGetArchive, err)
+	}
+
+	if err := archive.Close(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,207 @@
+package gittp
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Principal is the authenticated identity behind a request
+type Principal struct {
+	// Name is the user name the request authenticated as
+	Name string
+	// Claims holds verified details about the principal, such as the claims of the token or the subject of the client certificate the request authenticated with
+	Claims map[string]interface{}
+	// Scope limits the principal to the repositories and operations it grants, on top of what the server's Authorizer allows. A nil Scope places no extra limits.
+	Scope AccessPolicy
+}
+
+// Authenticator checks the credentials sent with a request
+type Authenticator interface {
+	// Authenticate returns the principal that the request's credentials belong to. Returning a nil principal and a nil error means the request did not carry any credentials, returning an error means the credentials were not valid.
+	Authenticate(req *http.Request) (*Principal, error)
+}
+
+// AuthenticatorFunc adapts a func into an Authenticator
+type AuthenticatorFunc func(req *http.Request) (*Principal, error)
+
+// Authenticate calls f(req)
+func (f AuthenticatorFunc) Authenticate(req *http.Request) (*Principal, error) {
+	return f(req)
+}
+
+// ChainAuthenticators combines several Authenticators, using the principal from the first one that recognizes the request's credentials
+func ChainAuthenticators(authenticators ...Authenticator) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*Principal, error) {
+		var lastErr error
+
+		for _, authenticator := range authenticators {
+			principal, err := authenticator.Authenticate(req)
+			if principal != nil && err == nil {
+				return principal, nil
+			} else if err != nil {
+				lastErr = err
+			}
+		}
+
+		return nil, lastErr
+	})
+}
+
+// StaticTokens authenticates requests that send one of a fixed set of tokens, either as the password of HTTP Basic auth or as a bearer token. tokens maps each token to the name of the principal it authenticates as.
+func StaticTokens(tokens map[string]string) Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*Principal, error) {
+		token := bearerToken(req)
+		if token == "" {
+			if _, password, ok := req.BasicAuth(); ok {
+				token = password
+			}
+		}
+
+		if token == "" {
+			return nil, nil
+		}
+
+		for t, name := range tokens {
+			if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+				return &Principal{Name: name}, nil
+			}
+		}
+
+		return nil, errInvalidCredentials
+	})
+}
+
+// ClientCertificates authenticates requests made over TLS with a client certificate that the server verified, using the certificate subject's common name as the principal's name. The full subject, email addresses and serial number of the certificate are kept in the principal's claims.
+func ClientCertificates() Authenticator {
+	return AuthenticatorFunc(func(req *http.Request) (*Principal, error) {
+		if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+			return nil, nil
+		}
+
+		if len(req.TLS.VerifiedChains) == 0 {
+			return nil, errInvalidCredentials
+		}
+
+		cert := req.TLS.VerifiedChains[0][0]
+		if cert.Subject.CommonName == "" {
+			return nil, errInvalidCredentials
+		}
+
+		return &Principal{
+			Name: cert.Subject.CommonName,
+			Claims: map[string]interface{}{
+				"subject": cert.Subject.String(),
+				"emails":  cert.EmailAddresses,
+				"serial":  cert.SerialNumber.String(),
+			},
+		}, nil
+	})
+}
+
+func bearerToken(req *http.Request) string {
+	authorization := req.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+
+	return ""
+}
+
+// Htpasswd authenticates HTTP Basic credentials against an htpasswd file of bcrypt hashed passwords, like the ones created with htpasswd -B. The file is read again whenever it changes.
+type Htpasswd struct {
+	path    string
+	mu      sync.Mutex
+	modTime time.Time
+	users   map[string][]byte
+}
+
+// NewHtpasswd loads the htpasswd file at path. An error is returned if the file cannot be read or has entries that are not bcrypt hashed.
+func NewHtpasswd(path string) (*Htpasswd, error) {
+	h := &Htpasswd{path: path}
+	if _, err := h.load(); err != nil {
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// Authenticate checks the request's basic auth credentials against the htpasswd file
+func (h *Htpasswd) Authenticate(req *http.Request) (*Principal, error) {
+	username, password, ok := req.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+
+	users, err := h.load()
+	if err != nil {
+		return nil, err
+	}
+
+	hash, ok := users[username]
+	if !ok {
+		return nil, errInvalidCredentials
+	}
+
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil {
+		return nil, errInvalidCredentials
+	}
+
+	return &Principal{Name: username}, nil
+}
+
+// load returns the users in the htpasswd file, reading it again if it was modified since it was last read
+func (h *Htpasswd) load() (map[string][]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stat, err := os.Stat(h.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.users != nil && stat.ModTime().Equal(h.modTime) {
+		return h.users, nil
+	}
+
+	f, err := os.Open(h.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := map[string][]byte{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		splits := strings.SplitN(entry, ":", 2)
+		if len(splits) != 2 || !strings.HasPrefix(splits[1], "$2") {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashed passwords are supported", h.path, line)
+		}
+
+		users[splits[0]] = []byte(splits[1])
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	h.users, h.modTime = users, stat.ModTime()
+	return users, nil
+}
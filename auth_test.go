@@ -0,0 +1,115 @@
+package gittp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func Test_StaticTokens(t *testing.T) {
+	auth := StaticTokens(map[string]string{"s3cr3t": "ci"})
+
+	noCreds := createRequest("GET", "/adam/test.git/info/refs?service=git-upload-pack")
+	if p, err := auth.Authenticate(noCreds); p != nil || err != nil {
+		t.Errorf("expected no principal and no error - actual %v %v", p, err)
+	}
+
+	basic := createRequest("GET", "/adam/test.git/info/refs?service=git-upload-pack")
+	basic.SetBasicAuth("anything", "s3cr3t")
+	if p, err := auth.Authenticate(basic); err != nil || p == nil || p.Name != "ci" {
+		t.Errorf("expected ci - actual %v %v", p, err)
+	}
+
+	bearer := createRequest("GET", "/adam/test.git/info/refs?service=git-upload-pack")
+	bearer.Header.Set("Authorization", "Bearer s3cr3t")
+	if p, err := auth.Authenticate(bearer); err != nil || p == nil || p.Name != "ci" {
+		t.Errorf("expected ci - actual %v %v", p, err)
+	}
+
+	wrong := createRequest("GET", "/adam/test.git/info/refs?service=git-upload-pack")
+	wrong.SetBasicAuth("ci", "guess")
+	if p, err := auth.Authenticate(wrong); err == nil || p != nil {
+		t.Errorf("expected an error - actual %v %v", p, err)
+	}
+}
+
+func Test_Htpasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gittp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	hash, _ := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	path := filepath.Join(dir, "htpasswd")
+	ioutil.WriteFile(path, []byte("# users\nadam:"+string(hash)+"\n"), 0600)
+
+	auth, err := NewHtpasswd(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := createRequest("GET", "/adam/test.git/info/refs?service=git-receive-pack")
+	req.SetBasicAuth("adam", "hunter2")
+	if p, err := auth.Authenticate(req); err != nil || p == nil || p.Name != "adam" {
+		t.Errorf("expected adam - actual %v %v", p, err)
+	}
+
+	req.SetBasicAuth("adam", "hunter3")
+	if p, err := auth.Authenticate(req); err == nil || p != nil {
+		t.Errorf("expected an error - actual %v %v", p, err)
+	}
+
+	req.SetBasicAuth("bob", "hunter2")
+	if p, err := auth.Authenticate(req); err == nil || p != nil {
+		t.Errorf("expected an error - actual %v %v", p, err)
+	}
+
+	ioutil.WriteFile(path, []byte("adam:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	if _, err := NewHtpasswd(path); err == nil {
+		t.Error("expected non bcrypt hashes to be refused")
+	}
+}
+
+func Test_ClientCertificates(t *testing.T) {
+	auth := ClientCertificates()
+
+	plain := createRequest("GET", "/adam/test.git/info/refs?service=git-upload-pack")
+	if p, err := auth.Authenticate(plain); p != nil || err != nil {
+		t.Errorf("expected no principal and no error - actual %v %v", p, err)
+	}
+
+	cert := &x509.Certificate{
+		Subject:        pkix.Name{CommonName: "build-agent", Organization: []string{"ci"}},
+		SerialNumber:   big.NewInt(42),
+		EmailAddresses: []string{"build@example.com"},
+	}
+
+	unverified := createRequest("GET", "/adam/test.git/info/refs?service=git-upload-pack")
+	unverified.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if p, err := auth.Authenticate(unverified); p != nil || err == nil {
+		t.Errorf("expected unverified certificates to be refused - actual %v %v", p, err)
+	}
+
+	verified := createRequest("GET", "/adam/test.git/info/refs?service=git-upload-pack")
+	verified.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+
+	p, err := auth.Authenticate(verified)
+	if err != nil || p == nil || p.Name != "build-agent" {
+		t.Fatalf("expected build-agent - actual %v %v", p, err)
+	}
+
+	if p.Claims["subject"] != "CN=build-agent,O=ci" || p.Claims["serial"] != "42" {
+		t.Errorf("unexpected claims %v", p.Claims)
+	}
+}
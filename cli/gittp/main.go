@@ -1,20 +1,35 @@
 package main
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
+	"time"
 
 	"github.com/adamveld12/gittp"
 	"github.com/braintree/manners"
 )
 
+// listenConfig is how the server listens for connections
+type listenConfig struct {
+	addr     string
+	certFile string
+	keyFile  string
+	tls      *tls.Config
+}
+
 func main() {
 
 	config := gittp.ServerConfig{}
-	addr, err := parseConfiguration(os.Args[1:], &config)
+	listen, err := parseConfiguration(os.Args[1:], &config)
 
 	if err != nil {
 		os.Exit(1)
@@ -22,7 +37,8 @@ func main() {
 
 	sv := manners.NewServer()
 
-	sv.Addr = addr
+	sv.Addr = listen.addr
+	sv.TLSConfig = listen.tls
 
 	handle, err := gittp.NewGitServer(config)
 	sv.Handler = handle
@@ -30,14 +46,21 @@ func main() {
 		log.Fatal("could not open dir", config.Path)
 	} else {
 		go func() {
-			fmt.Printf("Listening for git commands @ %v\n", addr)
-			if err := sv.ListenAndServe(); err != nil {
+			fmt.Printf("Listening for git commands @ %v\n", listen.addr)
+
+			if listen.certFile != "" {
+				err = sv.ListenAndServeTLS(listen.certFile, listen.keyFile)
+			} else {
+				err = sv.ListenAndServe()
+			}
+
+			if err != nil {
 				log.Fatal(err)
 			}
 		}()
 	}
 
-	sig := make(chan os.Signal)
+	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, os.Interrupt)
 
 	<-sig
@@ -48,24 +71,169 @@ func main() {
 	}
 }
 
-func parseConfiguration(args []string, config *gittp.ServerConfig) (addr string, err error) {
+func parseConfiguration(args []string, config *gittp.ServerConfig) (listen listenConfig, err error) {
 	fSet := flag.NewFlagSet("", flag.ContinueOnError)
 
-	var masterOnly, autocreate bool
-	fSet.StringVar(&addr, "addr", ":80", "The addr that gittp listens on")
+	var masterOnly, autocreate, requireSignedPush bool
+	var htpasswd, policy, jwks, jwtSecret, clientCA, protect, pushCertSeed, gpgHome, allowedSigners, signedCommits string
+	fSet.StringVar(&listen.addr, "addr", ":80", "The addr that gittp listens on")
+	fSet.StringVar(&listen.certFile, "tls-cert", "", "A PEM encoded certificate file, serves HTTPS when set along with -tls-key")
+	fSet.StringVar(&listen.keyFile, "tls-key", "", "The PEM encoded private key file for -tls-cert")
+	fSet.StringVar(&clientCA, "client-ca", "", "A PEM encoded CA bundle that client certificates are verified against. Clients authenticate as their certificate's common name")
 	fSet.StringVar(&config.Path, "path", "./repositories", "The path that gittp stores pushed repositories")
 	fSet.BoolVar(&masterOnly, "masteronly", false, "Only allow pushing to master")
 	fSet.BoolVar(&autocreate, "autocreate", false, "Auto creates repositories if they have not been created")
+	fSet.BoolVar(&config.RepositoryHooks, "repo-hooks", false, "Runs the pre-receive, update, post-receive and post-update scripts in each repository's hooks directory, which are not ran otherwise")
+	fSet.DurationVar(&config.HookTimeout, "hook-timeout", 0, "How long each hook may run before the push is rejected, 0 for no limit")
+	fSet.DurationVar(&config.RequestTimeout, "request-timeout", 0, "How long a request may take before its git processes are stopped, 0 for no limit")
 	fSet.BoolVar(&config.Debug, "debug", false, "Enables debug logging")
+	fSet.StringVar(&htpasswd, "htpasswd", "", "An htpasswd file of bcrypt hashed passwords, requires every request to authenticate when set")
+	fSet.StringVar(&jwks, "jwks", "", "A JWKS file of public keys that bearer JWTs are verified with")
+	fSet.StringVar(&jwtSecret, "jwt-secret", "", "A file holding the HMAC secret that bearer JWTs are verified with")
+	fSet.StringVar(&protect, "protect", "", "A branch protection rules file protecting refs from force pushes, deletion, unwanted pushers and commits not signed by a key from -gpg-home or -allowed-signers")
+	fSet.StringVar(&pushCertSeed, "push-cert-seed", "", "A file holding the secret that signed push nonces are made from, enables git push --signed when set")
+	fSet.StringVar(&gpgHome, "gpg-home", "", "A GnuPG home directory holding the keys that GPG signatures are verified against")
+	fSet.StringVar(&allowedSigners, "allowed-signers", "", "An SSH allowed signers file listing the keys that SSH signatures are verified against")
+	fSet.BoolVar(&requireSignedPush, "require-signed-push", false, "Only accept pushes signed by a key from -gpg-home or -allowed-signers, requires -push-cert-seed")
+	fSet.StringVar(&signedCommits, "signed-commits", "", "Comma separated ref globs whose new commits must be signed by a key from -gpg-home or -allowed-signers")
+	fSet.StringVar(&policy, "policy", "", "An access policy file granting read and write access to repositories")
+
+	if err = fSet.Parse(args); err != nil {
+		return
+	}
 
-	err = fSet.Parse(args)
+	if (listen.certFile == "") != (listen.keyFile == "") || (clientCA != "" && listen.certFile == "") {
+		err = errors.New("-tls-cert and -tls-key must be used together, and are required by -client-ca")
+		log.Println(err)
+		return
+	}
 
 	if autocreate {
 		config.PreCreate = gittp.CreateRepo
 	}
 
+	if requireSignedPush && pushCertSeed == "" {
+		err = errors.New("-require-signed-push needs -push-cert-seed")
+		log.Println(err)
+		return
+	}
+
+	if signedCommits != "" && gpgHome == "" && allowedSigners == "" {
+		err = errors.New("-signed-commits needs -gpg-home or -allowed-signers")
+		log.Println(err)
+		return
+	}
+
+	if gpgHome != "" || allowedSigners != "" {
+		config.Keyring = &gittp.Keyring{GPGHome: gpgHome, AllowedSigners: allowedSigners}
+	}
+
+	preReceive := []gittp.PreReceiveHook{}
+
 	if masterOnly {
-		config.PreReceive = gittp.MasterOnly
+		preReceive = append(preReceive, gittp.MasterOnly)
+	}
+
+	if requireSignedPush {
+		preReceive = append(preReceive, gittp.RequireSignedPush)
+	}
+
+	if signedCommits != "" {
+		preReceive = append(preReceive, gittp.VerifyCommitSignatures(config.Keyring, strings.Split(signedCommits, ",")...))
+	}
+
+	if len(preReceive) > 0 {
+		config.PreReceive = gittp.CombinePreHooks(preReceive...)
+	}
+
+	if pushCertSeed != "" {
+		seed, err := ioutil.ReadFile(pushCertSeed)
+		if err != nil {
+			log.Println("could not read push certificate seed", err)
+			return listen, err
+		}
+
+		config.PushCertNonceSeed = string(bytes.TrimSpace(seed))
+		config.PushCertNonceSlop = 5 * time.Minute
+	}
+
+	if protect != "" {
+		protection, err := gittp.LoadBranchProtection(protect, config.Keyring)
+		if err != nil {
+			log.Println("could not load branch protection rules", err)
+			return listen, err
+		}
+
+		config.Update = protection.Update
+	}
+
+	authenticators := []gittp.Authenticator{}
+
+	if clientCA != "" {
+		pem, err := ioutil.ReadFile(clientCA)
+		if err != nil {
+			log.Println("could not read client CA file", err)
+			return listen, err
+		}
+
+		listen.tls = &tls.Config{ClientCAs: x509.NewCertPool(), ClientAuth: tls.VerifyClientCertIfGiven}
+		if !listen.tls.ClientCAs.AppendCertsFromPEM(pem) {
+			err = errors.New("no certificates found in " + clientCA)
+			log.Println("could not load client CA file", err)
+			return listen, err
+		}
+
+		authenticators = append(authenticators, gittp.ClientCertificates())
+	}
+
+	if htpasswd != "" {
+		auth, err := gittp.NewHtpasswd(htpasswd)
+		if err != nil {
+			log.Println("could not load htpasswd file", err)
+			return listen, err
+		}
+
+		authenticators = append(authenticators, auth)
+	}
+
+	if jwks != "" || jwtSecret != "" {
+		auth := &gittp.JWTAuthenticator{Leeway: time.Minute}
+
+		if jwks != "" {
+			if auth.Keys, err = gittp.LoadJWKS(jwks); err != nil {
+				log.Println("could not load JWKS file", err)
+				return
+			}
+		}
+
+		if jwtSecret != "" {
+			if auth.Secret, err = ioutil.ReadFile(jwtSecret); err != nil {
+				log.Println("could not read JWT secret", err)
+				return
+			}
+
+			auth.Secret = bytes.TrimSpace(auth.Secret)
+		}
+
+		authenticators = append(authenticators, auth)
+	}
+
+	if len(authenticators) == 1 {
+		config.Authenticator = authenticators[0]
+	} else if len(authenticators) > 1 {
+		config.Authenticator = gittp.ChainAuthenticators(authenticators...)
+	}
+
+	// client certificates are the only way to authenticate, so there is no point letting anyone connect without one
+	if listen.tls != nil && len(authenticators) == 1 {
+		listen.tls.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if policy != "" {
+		if config.Authorizer, err = gittp.LoadAccessPolicy(policy); err != nil {
+			log.Println("could not load access policy", err)
+			return
+		}
 	}
 
 	log.SetFlags(log.Lshortfile | log.Ldate)
@@ -0,0 +1,232 @@
+package gittp
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// Signature is the author or committer of a commit
+type Signature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	When  time.Time `json:"date"`
+}
+
+// Commit is a commit in a repository
+type Commit struct {
+	Hash      string    `json:"id"`
+	Parents   []string  `json:"parents"`
+	Author    Signature `json:"author"`
+	Committer Signature `json:"committer"`
+	Message   string    `json:"message"`
+}
+
+// the fields of a commit as read by gitLog, separated by unit separators
+const commitFormat = "--format=%H%x1f%P%x1f%an%x1f%ae%x1f%aI%x1f%cn%x1f%ce%x1f%cI%x1f%B"
+
+// gitLog lists the commits selected by args, newest first
+func gitLog(ctx context.Context, fullRepoPath string, env []string, args ...string) ([]Commit, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"log", "-z", commitFormat}, args...)...)
+	cmd.Dir = fullRepoPath
+	cmd.Env = append(os.Environ(), env...)
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []Commit{}
+	for _, entry := range bytes.Split(output, null) {
+		fields := strings.SplitN(string(entry), "\x1f", 9)
+		if len(fields) != 9 {
+			continue
+		}
+
+		authored, _ := time.Parse(time.RFC3339, fields[4])
+		committed, _ := time.Parse(time.RFC3339, fields[7])
+
+		commits = append(commits, Commit{
+			Hash:      fields[0],
+			Parents:   strings.Fields(fields[1]),
+			Author:    Signature{fields[2], fields[3], authored},
+			Committer: Signature{fields[5], fields[6], committed},
+			Message:   strings.TrimRight(fields[8], "\n"),
+		})
+	}
+
+	return commits, nil
+}
+
+// updateType works out the kind of change a ref update makes
+func updateType(ctx context.Context, fullRepoPath string, env []string, update RefUpdate) UpdateType {
+	switch {
+	case update.Old == zeroHash:
+		return CreateUpdate
+	case update.New == zeroHash:
+		return DeleteUpdate
+	case isAncestor(ctx, fullRepoPath, env, update.Old, update.New):
+		return FastForwardUpdate
+	default:
+		return ForceUpdate
+	}
+}
+
+// isAncestor returns true if commit ancestor can be reached from commit descendant
+func isAncestor(ctx context.Context, fullRepoPath string, env []string, ancestor, descendant string) bool {
+	cmd := exec.CommandContext(ctx, "git", "merge-base", "--is-ancestor", ancestor, descendant)
+	cmd.Dir = fullRepoPath
+	cmd.Env = append(os.Environ(), env...)
+
+	return cmd.Run() == nil
+}
+
+// Commits returns the commits introduced by the push, newest first. These are the commits that no ref could reach before the push, and they can be read from both pre and post receive hooks.
+func (h *HookContext) Commits() ([]Commit, error) {
+	return h.commits(h.RefUpdates)
+}
+
+// RefCommits returns the commits introduced by a single ref update in the push, newest first. Deleting a ref introduces no commits.
+func (h *HookContext) RefCommits(update RefUpdate) ([]Commit, error) {
+	return h.commits([]RefUpdate{update})
+}
+
+// ChangedFiles returns the sorted paths of every file added, modified or deleted by the commits introduced in the push
+func (h *HookContext) ChangedFiles() ([]string, error) {
+	revisions := h.introduced(h.RefUpdates)
+	if len(revisions) == 0 {
+		return []string{}, nil
+	}
+
+	output, err := h.git(append([]string{"log", "-z", "--format=", "--name-only"}, revisions...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	files := []string{}
+	for _, file := range strings.Split(string(output), "\x00") {
+		file = strings.TrimSpace(file)
+		if file != "" && !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadBlob returns the contents of the file at path in the pushed commit
+func (h *HookContext) ReadBlob(path string) ([]byte, error) {
+	return h.git("cat-file", "blob", h.Commit+":"+path)
+}
+
+// unverifiedCommit is a commit without a signature from a trusted key, and why
+type unverifiedCommit struct {
+	Hash   string
+	Reason string
+}
+
+// verifyCommits checks the signature of every commit update introduces against keyring, returning the commits that are not signed by one of its keys
+func (h *HookContext) verifyCommits(keyring *Keyring, update RefUpdate) ([]unverifiedCommit, error) {
+	commits, err := h.RefCommits(update)
+	if err != nil {
+		return nil, err
+	}
+
+	unverified := []unverifiedCommit{}
+	for _, c := range commits {
+		payload, signature, err := h.commitSignature(c.Hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if signature == nil {
+			unverified = append(unverified, unverifiedCommit{c.Hash, "not signed"})
+		} else if _, _, err := keyring.Verify(h.Context(), payload, signature); err != nil {
+			unverified = append(unverified, unverifiedCommit{c.Hash, err.Error()})
+		}
+	}
+
+	return unverified, nil
+}
+
+// commitSignature splits a commit into the signature in its gpgsig header and the payload that was signed, the commit without that header. signature is nil for commits that are not signed.
+func (h *HookContext) commitSignature(hash string) (payload, signature []byte, err error) {
+	raw, err := h.git("cat-file", "commit", hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body := []byte{}
+	if end := bytes.Index(raw, []byte("\n\n")); end >= 0 {
+		raw, body = raw[:end+1], raw[end+1:]
+	}
+
+	inSignature := false
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		switch {
+		case bytes.HasPrefix(line, []byte("gpgsig ")) || bytes.HasPrefix(line, []byte("gpgsig-sha256 ")):
+			inSignature = true
+			signature = append(signature, line[bytes.IndexByte(line, ' ')+1:]...)
+		case inSignature && bytes.HasPrefix(line, []byte(" ")):
+			// the signature continues on lines indented by a space
+			signature = append(signature, line[1:]...)
+		default:
+			inSignature = false
+			payload = append(payload, line...)
+		}
+	}
+
+	return append(payload, body...), signature, nil
+}
+
+func (h *HookContext) commits(updates []RefUpdate) ([]Commit, error) {
+	revisions := h.introduced(updates)
+	if len(revisions) == 0 {
+		return []Commit{}, nil
+	}
+
+	return gitLog(h.Context(), h.FullRepoPath, h.objectEnv, revisions...)
+}
+
+// introduced builds the revisions selecting commits reachable from the new side of updates but not from any ref as it was before the push
+func (h *HookContext) introduced(updates []RefUpdate) []string {
+	revisions := []string{}
+	for _, u := range updates {
+		if u.New != zeroHash {
+			revisions = append(revisions, u.New)
+		}
+	}
+
+	if len(revisions) == 0 {
+		return revisions
+	}
+
+	// refs the push updates are left out, in case they have been updated already, and their old values are used instead
+	revisions = append(revisions, "--not")
+	old := []string{}
+	for _, u := range h.RefUpdates {
+		revisions = append(revisions, "--exclude="+u.Ref)
+		if u.Old != zeroHash {
+			old = append(old, u.Old)
+		}
+	}
+
+	return append(append(revisions, "--glob=refs/*"), old...)
+}
+
+func (h *HookContext) git(args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(h.Context(), "git", args...)
+	cmd.Dir = h.FullRepoPath
+	cmd.Env = append(os.Environ(), h.objectEnv...)
+
+	return cmd.Output()
+}
@@ -0,0 +1,130 @@
+package gittp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_HookContext_Commits(t *testing.T) {
+	repo, base := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	work := filepath.Join(filepath.Dir(repo), "clone")
+	runGit(t, filepath.Dir(repo), "clone", "-q", repo, work)
+
+	ioutil.WriteFile(filepath.Join(work, "README.md"), []byte("# changed\n"), 0644)
+	ioutil.WriteFile(filepath.Join(work, "main.go"), []byte("package main\n"), 0644)
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "second commit")
+	head := runGit(t, work, "rev-parse", "HEAD")
+
+	cmd := exec.Command("git", "pack-objects", "--stdout", "--revs", "--thin")
+	cmd.Dir = work
+	cmd.Stdin = bytes.NewBufferString(head + "\n^" + base + "\n")
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	q, err := newQuarantine(context.Background(), repo, bytes.NewReader(pack), readReceiveConfig(context.Background(), repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	update := RefUpdate{Old: base, New: head, Ref: "refs/heads/master"}
+	h := &HookContext{FullRepoPath: repo, Commit: head, RefUpdates: []RefUpdate{update}}
+
+	if _, err := h.ReadBlob("main.go"); err == nil {
+		t.Error("expected quarantined objects to be invisible without the quarantine")
+	}
+
+	h.objectEnv = q.env(repo)
+
+	commits, err := h.Commits()
+	if err != nil || len(commits) != 1 || commits[0].Hash != head || commits[0].Message != "second commit" || !reflect.DeepEqual(commits[0].Parents, []string{base}) {
+		t.Errorf("expected only the second commit but got %+v %v", commits, err)
+	}
+
+	files, err := h.ChangedFiles()
+	if expected := []string{"README.md", "main.go"}; err != nil || !reflect.DeepEqual(files, expected) {
+		t.Errorf("expected changed files %v but got %v %v", expected, files, err)
+	}
+
+	blob, err := h.ReadBlob("main.go")
+	if err != nil || string(blob) != "package main\n" {
+		t.Errorf("expected to read main.go from the pushed commit but got %q %v", blob, err)
+	}
+
+	deleted, err := h.RefCommits(RefUpdate{Old: base, New: zeroHash, Ref: "refs/heads/master"})
+	if err != nil || len(deleted) != 0 {
+		t.Errorf("expected deleting a ref to introduce no commits but got %+v %v", deleted, err)
+	}
+}
+
+func Test_updateType(t *testing.T) {
+	repo, base := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	work := filepath.Join(filepath.Dir(repo), "clone")
+	runGit(t, filepath.Dir(repo), "clone", "-q", repo, work)
+
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "forward")
+	forward := runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "commit", "-q", "--amend", "--allow-empty", "-m", "rewritten")
+	rewritten := runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "push", "-q", repo, forward+":refs/heads/forward", rewritten+":refs/heads/rewritten")
+
+	cases := []struct {
+		update   RefUpdate
+		expected UpdateType
+	}{
+		{RefUpdate{Old: zeroHash, New: base, Ref: "refs/heads/new"}, CreateUpdate},
+		{RefUpdate{Old: base, New: zeroHash, Ref: "refs/heads/master"}, DeleteUpdate},
+		{RefUpdate{Old: base, New: forward, Ref: "refs/heads/master"}, FastForwardUpdate},
+		{RefUpdate{Old: forward, New: rewritten, Ref: "refs/heads/master"}, ForceUpdate},
+	}
+
+	for _, c := range cases {
+		if actual := updateType(context.Background(), repo, nil, c.update); actual != c.expected {
+			t.Errorf("%s..%s: expected %s but got %s", c.update.Old, c.update.New, c.expected, actual)
+		}
+	}
+}
+
+// createSignedCommits makes a commit on top of base signed by a key the returned keyring trusts, one on top of that signed by a key it does not trust, and an unsigned one on top of base. Their objects are left in repo without any ref pointing at them, like a push that has not been accepted yet.
+func createSignedCommits(t *testing.T, repo, base string) (keyring *Keyring, signed, badlySigned, unsigned string) {
+	dir := filepath.Dir(repo)
+	work := filepath.Join(dir, "signed")
+	runGit(t, dir, "clone", "-q", repo, work)
+
+	trusted, untrusted := filepath.Join(dir, "trusted"), filepath.Join(dir, "untrusted")
+	for _, k := range []string{trusted, untrusted} {
+		if err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", k).Run(); err != nil {
+			t.Skip("ssh-keygen is needed to sign commits", err)
+		}
+	}
+
+	pub, _ := ioutil.ReadFile(trusted + ".pub")
+	allowed := filepath.Join(dir, "allowed_signers")
+	ioutil.WriteFile(allowed, append([]byte("adam@example.com "), pub...), 0644)
+
+	runGit(t, work, "-c", "gpg.format=ssh", "-c", "user.signingkey="+trusted, "commit", "-q", "-S", "--allow-empty", "-m", "signed")
+	signed = runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "-c", "gpg.format=ssh", "-c", "user.signingkey="+untrusted, "commit", "-q", "-S", "--allow-empty", "-m", "untrusted")
+	badlySigned = runGit(t, work, "rev-parse", "HEAD")
+	runGit(t, work, "reset", "-q", "--hard", base)
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "unsigned")
+	unsigned = runGit(t, work, "rev-parse", "HEAD")
+
+	runGit(t, work, "push", "-q", repo, badlySigned+":refs/heads/a", unsigned+":refs/heads/b")
+	runGit(t, work, "push", "-q", repo, ":refs/heads/a", ":refs/heads/b")
+
+	return &Keyring{AllowedSigners: allowed}, signed, badlySigned, unsigned
+}
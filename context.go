@@ -2,14 +2,17 @@ package gittp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -17,8 +20,10 @@ type streamCode string
 
 var (
 	serviceRegexp          = regexp.MustCompile("(?:/info/refs\\?service=|/)(git-(?:receive|upload)-pack)$")
+	gitProtocolRegexp      = regexp.MustCompile("^[a-zA-Z0-9=:._-]+$")
 	errNoMatchingService   = errors.New("No matching service types found")
 	errCouldNotReadReqBody = errors.New("couldn't read request body")
+	errUnsupportedEncoding = errors.New("unsupported request body content encoding")
 
 	packDataStreamCode = streamCode("\u0001")
 	progressStreamCode = streamCode("\u0002")
@@ -27,38 +32,64 @@ var (
 
 type handlerContext struct {
 	packetHeader
-	ShouldRunHooks bool
-	Advertisement  bool
-	IsReceivePack  bool
-	IsGetRefs      bool
-	RepoExists     bool
-	FullRepoPath   string
-	RepoName       string
-	ServiceType    string
-	Input          io.Reader
-	Output         io.Writer
+	ShouldRunHooks  bool
+	Advertisement   bool
+	IsReceivePack   bool
+	IsGetRefs       bool
+	RepoExists      bool
+	FullRepoPath    string
+	RepoName        string
+	ServiceType     string
+	GitProtocol     string
+	ProtocolVersion int
+	Command         string
+	Principal       *Principal
+	Upload          uploadRequest
+	Context         context.Context
+	Input           io.Reader
+	Body            io.Reader
+	Output          http.ResponseWriter
 }
 
 // TODO needs tests
-func newHandlerContext(res http.ResponseWriter, req *http.Request, repoPath string) (handlerContext, error) {
+func newHandlerContext(res http.ResponseWriter, req *http.Request, repoPath string, principal *Principal) (handlerContext, error) {
 	serviceTypeStr, err := detectServiceType(req.URL)
 	if err != nil {
 		return handlerContext{}, err
 	}
 
-	url := req.URL
-	repoName, err := parseRepoName(url.String())
+	repoName, err := parseRepoName(req.URL.String())
 	if err != nil {
 		return handlerContext{}, err
 	}
 
+	// the name is taken from the escaped url, so an escaped / cannot sneak a .. past cleanRepoName
+	if repoName, err = url.PathUnescape(repoName); err != nil {
+		return handlerContext{}, errInvalidRepoName
+	}
+
+	repoName, ok := cleanRepoName(repoName)
+	if !ok {
+		return handlerContext{}, errInvalidRepoName
+	}
+
+	fullRepoPath, ok := repoPathWithin(repoPath, repoName)
+	if !ok {
+		return handlerContext{}, errInvalidRepoName
+	}
+
 	advertise := req.Method == "GET"
-	isGetRefs := advertise && strings.Contains(url.RequestURI(), "/info/refs?service=")
+	isGetRefs := advertise && strings.Contains(req.URL.RequestURI(), "/info/refs?service=")
 	isReceivePack := serviceTypeStr == "git-receive-pack"
 	shouldRunHooks := isReceivePack && !advertise
 
+	body, err := decodeRequestBody(req)
+	if err != nil {
+		return handlerContext{}, err
+	}
+
 	// the request body in a multi reader
-	refsHeader, err := readPackInfo(req.Body)
+	refsHeader, err := readPackInfo(body)
 	if err != nil {
 		return handlerContext{}, errCouldNotReadReqBody
 	}
@@ -67,31 +98,88 @@ func newHandlerContext(res http.ResponseWriter, req *http.Request, repoPath stri
 		shouldRunHooks = false
 	}
 
-	fullRepoPath := filepath.Join(repoPath, repoName)
+	gitProtocol := req.Header.Get("Git-Protocol")
+	if !gitProtocolRegexp.MatchString(gitProtocol) {
+		gitProtocol = ""
+	}
+
+	protocolVersion := parseProtocolVersion(gitProtocol)
+
+	var command string
+	if protocolVersion == 2 && !advertise && !isReceivePack {
+		command = parseCommandRequest(refsHeader)
+	}
+
+	var upload uploadRequest
+	if !advertise && !isReceivePack {
+		upload = parseUploadRequest(refsHeader)
+	}
 
 	var rpr packetHeader
 	if !advertise && isReceivePack {
 		rpr = newPacketHeader(refsHeader)
+
+		// push options come after the command list in a list of their own
+		if hasCapability(rpr.Capabilities, "push-options") {
+			options, err := readPackInfo(body)
+			if err != nil {
+				return handlerContext{}, errCouldNotReadReqBody
+			}
+
+			rpr.PushOptions = parsePushOptions(options)
+			refsHeader = append(refsHeader, options...)
+		}
 	}
 
 	_, ferr := os.Stat(fullRepoPath)
 	fileExists := !os.IsNotExist(ferr)
 
 	return handlerContext{
-		packetHeader:   rpr,
-		ServiceType:    serviceTypeStr,
-		IsReceivePack:  isReceivePack,
-		Advertisement:  advertise,
-		ShouldRunHooks: shouldRunHooks,
-		IsGetRefs:      isGetRefs,
-		RepoName:       repoName,
-		RepoExists:     fileExists,
-		FullRepoPath:   fullRepoPath,
-		Input:          io.MultiReader(bytes.NewBuffer(refsHeader), req.Body),
-		Output:         io.MultiWriter(res, os.Stdout),
+		packetHeader:    rpr,
+		ServiceType:     serviceTypeStr,
+		GitProtocol:     gitProtocol,
+		ProtocolVersion: protocolVersion,
+		Command:         command,
+		Principal:       principal,
+		Upload:          upload,
+		Context:         req.Context(),
+		IsReceivePack:   isReceivePack,
+		Advertisement:   advertise,
+		ShouldRunHooks:  shouldRunHooks,
+		IsGetRefs:       isGetRefs,
+		RepoName:        repoName,
+		RepoExists:      fileExists,
+		FullRepoPath:    fullRepoPath,
+		Input:           io.MultiReader(bytes.NewBuffer(refsHeader), body),
+		Body:            body,
+		Output:          res,
 	}, nil
 }
 
+// decodeRequestBody transparently decompresses request bodies sent with a gzip or deflate Content-Encoding
+func decodeRequestBody(req *http.Request) (io.Reader, error) {
+	switch strings.ToLower(req.Header.Get("Content-Encoding")) {
+	case "", "identity":
+		return req.Body, nil
+	case "gzip", "x-gzip":
+		body, err := gzip.NewReader(req.Body)
+		if err != nil {
+			return nil, errCouldNotReadReqBody
+		}
+
+		return body, nil
+	case "deflate":
+		body, err := zlib.NewReader(req.Body)
+		if err != nil {
+			return nil, errCouldNotReadReqBody
+		}
+
+		return body, nil
+	}
+
+	return nil, errUnsupportedEncoding
+}
+
 func contentType(serviceType string, isAdvertisement bool) string {
 	handlerContentType := "result"
 
@@ -102,6 +190,23 @@ func contentType(serviceType string, isAdvertisement bool) string {
 	return fmt.Sprintf("application/x-%s-%s", serviceType, handlerContentType)
 }
 
+// parseProtocolVersion finds the protocol version a client asked for in its Git-Protocol header, defaulting to version 0
+func parseProtocolVersion(gitProtocol string) int {
+	version := 0
+
+	for _, param := range strings.Split(gitProtocol, ":") {
+		if !strings.HasPrefix(param, "version=") {
+			continue
+		}
+
+		if v, err := strconv.Atoi(strings.TrimPrefix(param, "version=")); err == nil && v > version {
+			version = v
+		}
+	}
+
+	return version
+}
+
 func detectServiceType(url *url.URL) (string, error) {
 	match := serviceRegexp.FindStringSubmatch(url.RequestURI())
 	if len(match) < 2 {
@@ -111,31 +216,132 @@ func detectServiceType(url *url.URL) (string, error) {
 	return match[1], nil
 }
 
+// UploadContext describes a fetch or clone, for PreUploadHooks
+type UploadContext struct {
+	// Repository is the name of the repository being fetched from
+	Repository   string
+	FullRepoPath string
+	// Principal is who is fetching, when the server is configured with an Authenticator
+	Principal *Principal
+	// Advertisement is true when the client is asking for the repository's refs or, with protocol v2, its capabilities, and false when it is asking for a pack
+	Advertisement bool
+	// ProtocolVersion is the git wire protocol version the client asked for
+	ProtocolVersion int
+	// Command is the protocol v2 command being ran, like ls-refs or fetch
+	Command string
+	// Wants are the object ids the client asked for, and WantRefs are the refs asked for by name with protocol v2
+	Wants    []string
+	WantRefs []string
+	// Shallow are the commits the client's shallow clone stops at
+	Shallow []string
+	// Depth is how many commits deep a shallow fetch asked for, zero when it did not
+	Depth int
+	// DeepenSince is the unix time a shallow fetch asked for history back to, zero when it did not
+	DeepenSince int64
+	// DeepenNot are the refs a shallow fetch asked to leave out the history of
+	DeepenNot []string
+	// File is the repository file a dumb HTTP client asked for, like info/refs or an object, and empty for smart HTTP
+	File string
+	ctx  context.Context
+}
+
+// Context is cancelled when the client goes away or the request times out
+func (u *UploadContext) Context() context.Context {
+	if u.ctx == nil {
+		return context.Background()
+	}
+
+	return u.ctx
+}
+
+func newUploadContext(ctx handlerContext) *UploadContext {
+	return &UploadContext{
+		Repository:      ctx.RepoName,
+		FullRepoPath:    ctx.FullRepoPath,
+		Principal:       ctx.Principal,
+		Advertisement:   ctx.Advertisement,
+		ProtocolVersion: ctx.ProtocolVersion,
+		Command:         ctx.Command,
+		Wants:           ctx.Upload.Wants,
+		WantRefs:        ctx.Upload.WantRefs,
+		Shallow:         ctx.Upload.Shallow,
+		Depth:           ctx.Upload.Depth,
+		DeepenSince:     ctx.Upload.DeepenSince,
+		DeepenNot:       ctx.Upload.DeepenNot,
+		ctx:             ctx.Context,
+	}
+}
+
 func newHookContext(ctx handlerContext) *HookContext {
 	return &HookContext{
-		ctx.RepoName,
-		ctx.FullRepoPath,
-		ctx.Branch,
-		ctx.Head,
-		ctx.RepoExists,
-		ctx.Output,
+		Repository:   ctx.RepoName,
+		FullRepoPath: ctx.FullRepoPath,
+		Branch:       ctx.Branch,
+		Commit:       ctx.Head,
+		RefUpdates:   ctx.Updates,
+		RepoExists:   ctx.RepoExists,
+		Principal:    ctx.Principal,
+		PushOptions:  ctx.PushOptions,
+		ctx:          ctx.Context,
+		w:            ctx.Output,
+		capabilities: ctx.Capabilities,
 	}
 }
 
+// RefUpdate is a single command from the command list of a push, describing a ref moving from one commit to another. Old is all zeros when the ref is being created, and New is all zeros when it is being deleted.
+type RefUpdate struct {
+	// Old is the commit hash the ref currently points to
+	Old string `json:"old"`
+	// New is the commit hash the ref is being updated to
+	New string `json:"new"`
+	// Ref is the full name of the ref being updated, ie refs/heads/master
+	Ref string `json:"ref"`
+	// Type is the kind of change the update makes, worked out from the repository's object graph once the push's objects are received
+	Type UpdateType `json:"type,omitempty"`
+}
+
+// UpdateType is the kind of change a ref update makes
+type UpdateType string
+
+const (
+	// CreateUpdate creates a ref that did not exist
+	CreateUpdate UpdateType = "create"
+	// DeleteUpdate deletes a ref
+	DeleteUpdate UpdateType = "delete"
+	// FastForwardUpdate moves a ref to a descendant of the commit it pointed to
+	FastForwardUpdate UpdateType = "fast-forward"
+	// ForceUpdate moves a ref to a commit that does not descend from the one it pointed to, rewriting its history
+	ForceUpdate UpdateType = "force"
+)
+
 // HookContext represents the current context about an on going push for hook handlers. It contains the repo name, branch name, the commit hash and a sideband channel that can be used to write status update messsages to the client.
 type HookContext struct {
 	// Repository is the name of the repository being pushed to
 	Repository   string
 	FullRepoPath string
-	// Branch is the name of the branch being pushed
+	// Branch is the name of the first ref being pushed
 	Branch string
-	// Commit is the commit hash being pushed
+	// Commit is the commit hash of the first ref being pushed
 	Commit string
+	// RefUpdates holds every ref update in the push, in the order the client sent them
+	RefUpdates []RefUpdate
 	// RepoExists is true if the repository being pushed to exists on the remote. If this value is false and the PreReceiveHook succeeds, gittp will auto initialize a bare repo befure handling the request.
 	RepoExists bool
-	w          io.Writer
+	// Principal is who pushed, when the server is configured with an Authenticator
+	Principal *Principal
+	// PushCertificate is the certificate of a signed push, nil when the push was not signed
+	PushCertificate *PushCertificate
+	// PushOptions are the options the client pushed with, like git push -o ci.skip
+	PushOptions []string
+	ctx         context.Context
+	w           io.Writer
+	// capabilities are what the client negotiated, deciding which side-band, if any, writes go over
+	capabilities []string
+	// objectEnv points git commands at the quarantined objects of a push that has not been accepted yet
+	objectEnv []string
 }
 
+// flush sends what has been written so far to the client straight away, when w is an http.ResponseWriter that can
 func flush(w io.Writer) {
 	f, ok := w.(http.Flusher)
 	if ok {
@@ -143,17 +349,36 @@ func flush(w io.Writer) {
 	}
 }
 
+// Context is cancelled when the client goes away, the request times out or the hook runs past ServerConfig.HookTimeout. Hooks doing slow work should give up once it is done.
+func (h *HookContext) Context() context.Context {
+	if h.ctx == nil {
+		return context.Background()
+	}
+
+	return h.ctx
+}
+
 // Fatal writes a fatal error to the git client. Useful when you want to signal that a push failed
 func (h *HookContext) Fatal(msg string) error {
-	payload := fmt.Sprintf("%serror: %s\n", fatalStreamCode, msg)
-	_, err := h.w.Write(pktline(payload))
+	defer flush(h.w)
+
+	// clients without a side-band can still be sent an ERR packet, which they die on
+	if sidebandPayload(h.capabilities) == 0 {
+		if len(msg) > maxPktPayload-len("ERR ") {
+			msg = msg[:maxPktPayload-len("ERR ")]
+		}
+
+		_, err := h.w.Write(pktline("ERR " + msg))
+		return err
+	}
+
+	_, err := newSidebandWriter(h.w, h.capabilities, fatalStreamCode).Write([]byte(fmt.Sprintf("error: %s\n", msg)))
 	return err
 }
 
-// Write writes a []byte to the git client
+// Write writes a []byte to the git client as progress, split over as many packets as it needs. It is dropped when the client did not negotiate a side-band.
 func (h *HookContext) Write(data []byte) (i int, e error) {
-	defer flush(h.w)
-	return h.w.Write(encodeWithPrefix(progressStreamCode, string(data)))
+	return newSidebandWriter(h.w, h.capabilities, progressStreamCode).Write(data)
 }
 
 // Writelnf writes a string to the git client using a format string and parameters
@@ -163,7 +388,11 @@ func (h *HookContext) Writelnf(fmtString string, params ...interface{}) error {
 
 // Writeln writes a string to the git client
 func (h *HookContext) Writeln(text string) error {
-	defer flush(h.w)
-	_, err := h.w.Write(encodeWithPrefix(progressStreamCode, text+"\n"))
+	_, err := h.Write([]byte(text + "\n"))
 	return err
 }
+
+// Archive returns a snapshot of the pushed commit in the given format, streamed from git archive as it is read instead of being held in memory. git archive is not started until the first Read, and the caller must Close the archive when done with it.
+func (h *HookContext) Archive(format ArchiveFormat) io.ReadCloser {
+	return newArchiveReader(h.Context(), h.FullRepoPath, h.Commit, format)
+}
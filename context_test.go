@@ -2,7 +2,12 @@ package gittp
 
 import (
 	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
 	"testing"
 )
 
@@ -72,3 +77,93 @@ func Test_detectServiceType(t *testing.T) {
 		}
 	}
 }
+
+func Test_parseProtocolVersion(t *testing.T) {
+	testCases := map[string]int{
+		"":                              0,
+		"version=1":                     1,
+		"version=2":                     2,
+		"object-format=sha1:version=2":  2,
+		"version=two":                   0,
+		"version=1:version=2:version=0": 2,
+	}
+
+	for gitProtocol, expected := range testCases {
+		if actual := parseProtocolVersion(gitProtocol); actual != expected {
+			t.Errorf("%s expected %d - actual %d", gitProtocol, expected, actual)
+		}
+	}
+}
+
+func Test_decodeRequestBody(t *testing.T) {
+	payload := "0032want 68839ad5d8bedf1147c214e4897ca6ad8afbfecc\n0000"
+
+	gzipped := &bytes.Buffer{}
+	gw := gzip.NewWriter(gzipped)
+	gw.Write([]byte(payload))
+	gw.Close()
+
+	deflated := &bytes.Buffer{}
+	zw := zlib.NewWriter(deflated)
+	zw.Write([]byte(payload))
+	zw.Close()
+
+	testCases := map[string][]byte{
+		"":        []byte(payload),
+		"gzip":    gzipped.Bytes(),
+		"x-gzip":  gzipped.Bytes(),
+		"deflate": deflated.Bytes(),
+	}
+
+	for encoding, body := range testCases {
+		req, _ := http.NewRequest("POST", "/adam/test.git/git-upload-pack", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", encoding)
+
+		decoded, err := decodeRequestBody(req)
+		if err != nil {
+			t.Fatal(encoding, err)
+		}
+
+		actual, _ := io.ReadAll(decoded)
+		if string(actual) != payload {
+			t.Errorf("%s expected:\n%q\nactual:\n%q\n", encoding, payload, actual)
+		}
+	}
+
+	req := createRequest("POST", "/adam/test.git/git-upload-pack")
+	req.Header.Set("Content-Encoding", "br")
+	if _, err := decodeRequestBody(req); err != errUnsupportedEncoding {
+		t.Errorf("expected %v - actual %v", errUnsupportedEncoding, err)
+	}
+}
+
+func Test_newHandlerContext_pushOptions(t *testing.T) {
+	command := "0000000000000000000000000000000000000000 68839ad5d8bedf1147c214e4897ca6ad8afbfecc refs/heads/master\x00report-status"
+	options := "000cci.skip\n0017reviewer=bob smith\n0000"
+
+	testCases := []struct {
+		body     string
+		expected []string
+	}{
+		{string(pktline(command+" push-options\n")) + "0000" + options, []string{"ci.skip", "reviewer=bob smith"}},
+		{string(pktline(command+" push-options\n")) + "0000" + "0000", []string{}},
+		{string(pktline(command+"\n")) + "0000", nil},
+	}
+
+	for _, c := range testCases {
+		req, _ := http.NewRequest("POST", "/adam/test.git/git-receive-pack", bytes.NewBufferString(c.body+"PACK...."))
+
+		ctx, err := newHandlerContext(httptest.NewRecorder(), req, "/tmp", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(ctx.PushOptions, c.expected) {
+			t.Errorf("expected push options %q - actual %q", c.expected, ctx.PushOptions)
+		}
+
+		if pack, _ := io.ReadAll(ctx.Body); string(pack) != "PACK...." {
+			t.Errorf("expected the pack to follow the push options, actual %q", pack)
+		}
+	}
+}
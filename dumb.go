@@ -0,0 +1,118 @@
+package gittp
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var dumbRequestRegexp = regexp.MustCompile("^/?(.+?)/(HEAD|info/refs|objects/info/(?:alternates|http-alternates|packs)|objects/[0-9a-f]{2}/[0-9a-f]{38}|objects/pack/pack-[0-9a-f]{40}\\.(?:pack|idx))$")
+
+// parseDumbRequest splits a dumb HTTP protocol request into the repository name and the file being requested from it
+func parseDumbRequest(u *url.URL) (repoName string, file string, ok bool) {
+	if u.Query().Get("service") != "" {
+		return "", "", false
+	}
+
+	match := dumbRequestRegexp.FindStringSubmatch(u.Path)
+	if len(match) < 3 {
+		return "", "", false
+	}
+
+	if repoName, ok = cleanRepoName(match[1]); !ok {
+		return "", "", false
+	}
+
+	return repoName, match[2], true
+}
+
+func dumbContentType(file string) string {
+	switch {
+	case strings.HasSuffix(file, ".pack"):
+		return "application/x-git-packed-objects"
+	case strings.HasSuffix(file, ".idx"):
+		return "application/x-git-packed-objects-toc"
+	case strings.HasPrefix(file, "objects/") && !strings.HasPrefix(file, "objects/info/"):
+		return "application/x-git-loose-object"
+	}
+
+	return "text/plain; charset=utf-8"
+}
+
+// preUploadDumb asks the PreUpload hook whether a dumb HTTP client may have a file, answering with a 403 when it may not. Dumb clients don't read pkt-lines, so the reason is sent as plain text.
+func (g *gitHTTPServer) preUploadDumb(res http.ResponseWriter, req *http.Request, principal *Principal, repoName, file string) bool {
+	err := g.PreUpload(&UploadContext{
+		Repository:    repoName,
+		FullRepoPath:  filepath.Join(g.Path, repoName),
+		Principal:     principal,
+		Advertisement: file == "info/refs" || file == "HEAD",
+		File:          file,
+		ctx:           req.Context(),
+	})
+	if err == nil {
+		return true
+	}
+
+	if g.Debug {
+		log.Println("dumb fetch declined by pre upload hook", err)
+	}
+
+	http.Error(res, err.Error(), http.StatusForbidden)
+	return false
+}
+
+// serveDumb serves a file from a repository for clients speaking the dumb HTTP protocol
+func (g *gitHTTPServer) serveDumb(res http.ResponseWriter, req *http.Request, repoName, file string) {
+	fullRepoPath := filepath.Join(g.Path, repoName)
+	if _, err := os.Stat(fullRepoPath); err != nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// info files are generated by git update-server-info, which may not have ran yet for this repository
+	if file == "info/refs" || file == "objects/info/packs" {
+		if _, err := os.Stat(filepath.Join(fullRepoPath, file)); os.IsNotExist(err) {
+			if err := updateServerInfo(req.Context(), fullRepoPath); err != nil && g.Debug {
+				log.Println("could not update server info", err)
+			}
+		}
+	}
+
+	f, err := os.Open(filepath.Join(fullRepoPath, filepath.FromSlash(file)))
+	if err != nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil || stat.IsDir() {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	header := res.Header()
+	header.Set("Content-Type", dumbContentType(file))
+
+	// objects never change once written, so they are safe to cache
+	if contentType := header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		header.Del("Pragma")
+		header.Set("Cache-Control", "public, max-age=31536000")
+		header.Set("Expires", stat.ModTime().AddDate(1, 0, 0).UTC().Format(http.TimeFormat))
+	}
+
+	http.ServeContent(res, req, "", stat.ModTime(), f)
+}
+
+func updateServerInfo(ctx context.Context, fullRepoPath string) error {
+	cmd := exec.CommandContext(ctx, "git", "update-server-info")
+	cmd.Dir = fullRepoPath
+
+	return cmd.Run()
+}
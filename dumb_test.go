@@ -0,0 +1,93 @@
+package gittp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_parseDumbRequest(t *testing.T) {
+	testCases := map[string][2]string{
+		"/adam/project.git/info/refs":                                                      {"adam/project.git", "info/refs"},
+		"/adam/project.git/HEAD":                                                           {"adam/project.git", "HEAD"},
+		"/adam/dude/project/objects/info/packs":                                            {"adam/dude/project", "objects/info/packs"},
+		"/adam/project.git/objects/68/839ad5d8bedf1147c214e4897ca6ad8afbfecc":              {"adam/project.git", "objects/68/839ad5d8bedf1147c214e4897ca6ad8afbfecc"},
+		"/adam/project.git/objects/pack/pack-68839ad5d8bedf1147c214e4897ca6ad8afbfecc.idx": {"adam/project.git", "objects/pack/pack-68839ad5d8bedf1147c214e4897ca6ad8afbfecc.idx"},
+		"/adam/project.git/info/refs?service=git-upload-pack":                              {},
+		"/adam/project.git/git-upload-pack":                                                {},
+		"/adam/project.git/config":                                                         {},
+		"/adam/project.git/objects/68/../../config":                                        {},
+		"/../../etc/info/refs":                                                             {},
+	}
+
+	for rawURL, expected := range testCases {
+		repoName, file, ok := parseDumbRequest(parseURL(rawURL))
+
+		if ok != (expected[0] != "") {
+			t.Errorf("%s expected match %v", rawURL, !ok)
+		} else if repoName != expected[0] || file != expected[1] {
+			t.Errorf("%s\nexpected:\n%v\nactual:\n%s %s\n", rawURL, expected, repoName, file)
+		}
+	}
+}
+
+func Test_gitHTTPServer_preUpload(t *testing.T) {
+	repo, _ := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	uploads := []*UploadContext{}
+	handler, err := NewGitServer(ServerConfig{
+		Path:     filepath.Dir(repo),
+		DumbHTTP: true,
+		PreUpload: func(u *UploadContext) error {
+			uploads = append(uploads, u)
+			return errors.New("reads are closed")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		url      string
+		code     int
+		expected string
+		file     string
+	}{
+		{"/repo.git/info/refs?service=git-upload-pack", http.StatusOK, "001e# service=git-upload-pack\n0000" + "0019ERR reads are closed\n", ""},
+		{"/repo.git/info/refs", http.StatusForbidden, "reads are closed\n", "info/refs"},
+		{"/repo.git/HEAD", http.StatusForbidden, "reads are closed\n", "HEAD"},
+	}
+
+	for _, c := range cases {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", c.url, nil))
+
+		if res.Code != c.code || res.Body.String() != c.expected {
+			t.Errorf("%s\nexpected: %d %q\nactual: %d %q", c.url, c.code, c.expected, res.Code, res.Body.String())
+		}
+
+		if u := uploads[len(uploads)-1]; u.Repository != "repo.git" || !u.Advertisement || u.File != c.file {
+			t.Errorf("%s: expected the hook to see an advertisement of %q from repo.git but got %+v", c.url, c.file, u)
+		}
+	}
+
+	if len(uploads) != len(cases) {
+		t.Errorf("expected the hook to run %d times but it ran %d", len(cases), len(uploads))
+	}
+
+	// a denied fetch of a missing repository doesn't create it
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/missing.git/info/refs?service=git-upload-pack", nil))
+	if !strings.HasSuffix(res.Body.String(), "0019ERR reads are closed\n") {
+		t.Errorf("expected the fetch of missing.git to be denied - actual %q", res.Body.String())
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(repo), "missing.git")); !os.IsNotExist(err) {
+		t.Error("expected missing.git not to be created")
+	}
+}
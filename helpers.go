@@ -2,7 +2,10 @@ package gittp
 
 import (
 	"errors"
+	"fmt"
+	"path"
 	"regexp"
+	"strings"
 )
 
 // CreateRepo will always create a new repository if one does not exist
@@ -24,13 +27,90 @@ func UseGithubRepoNames(reponame string) bool {
 
 // MasterOnly is a pre receive hook that only allows pushes to master
 func MasterOnly(h *HookContext) error {
-	if h.Branch == "refs/heads/master" {
-		return nil
+	for _, update := range h.RefUpdates {
+		if update.Ref != "refs/heads/master" {
+			return errors.New("only ref updates to refs/heads/master are allowed")
+		}
+	}
+
+	return nil
+}
+
+// DenyForcePush is a pre receive hook that rejects pushes rewriting the history of any ref
+func DenyForcePush(h *HookContext) error {
+	for _, update := range h.RefUpdates {
+		if update.Type == ForceUpdate {
+			return fmt.Errorf("force pushing %s is not allowed", update.Ref)
+		}
+	}
+
+	return nil
+}
+
+// DenyDeletes is a pre receive hook that rejects pushes deleting any ref
+func DenyDeletes(h *HookContext) error {
+	for _, update := range h.RefUpdates {
+		if update.Type == DeleteUpdate {
+			return fmt.Errorf("deleting %s is not allowed", update.Ref)
+		}
 	}
 
-	h.Fatal("Only ref updates to refs/heads/master are allowed.")
+	return nil
+}
+
+// RequireSignedPush is a pre receive hook that only accepts signed pushes, with a push certificate signed by a key in ServerConfig.Keyring over a nonce the server recently handed out
+func RequireSignedPush(h *HookContext) error {
+	cert := h.PushCertificate
 
-	return errors.New("hook declined")
+	switch {
+	case cert == nil:
+		return errors.New("pushes must be signed, use git push --signed")
+	case !cert.Verified:
+		return errors.New("the push certificate signature could not be verified")
+	case cert.NonceStatus != NonceOK:
+		return fmt.Errorf("the push certificate nonce is %s", cert.NonceStatus)
+	}
+
+	return nil
+}
+
+// VerifyCommitSignatures makes a pre receive hook that rejects pushes introducing commits that are not signed by a key in keyring, on the refs matching any of the globs in path.Match syntax, or on every ref when there are none. The offending commits are listed to the client. Without a keyring every push is rejected, since no signature can be verified.
+func VerifyCommitSignatures(keyring *Keyring, refs ...string) PreReceiveHook {
+	return func(h *HookContext) error {
+		if keyring == nil {
+			return errNoKeyring
+		}
+
+		offending := []string{}
+
+		for _, update := range h.RefUpdates {
+			matched := len(refs) == 0
+			for _, glob := range refs {
+				m, _ := path.Match(glob, update.Ref)
+				matched = matched || m
+			}
+
+			if !matched || update.Type == DeleteUpdate {
+				continue
+			}
+
+			unverified, err := h.verifyCommits(keyring, update)
+			if err != nil {
+				return err
+			}
+
+			for _, c := range unverified {
+				offending = append(offending, fmt.Sprintf("  %s %s: %s", c.Hash, update.Ref, c.Reason))
+			}
+		}
+
+		if len(offending) == 0 {
+			return nil
+		}
+
+		h.Fatal("commits must be signed by a trusted key\n" + strings.Join(offending, "\n"))
+		return fmt.Errorf("%d commits are not signed by a trusted key", len(offending))
+	}
 }
 
 // CombinePreHooks combines several PreReceiveHooks into one
@@ -0,0 +1,80 @@
+package gittp
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_DenyForcePush_DenyDeletes(t *testing.T) {
+	cases := []struct {
+		updateType   UpdateType
+		forceDenied  bool
+		deleteDenied bool
+	}{
+		{CreateUpdate, false, false},
+		{FastForwardUpdate, false, false},
+		{ForceUpdate, true, false},
+		{DeleteUpdate, false, true},
+	}
+
+	for _, c := range cases {
+		h := &HookContext{RefUpdates: []RefUpdate{
+			{Ref: "refs/heads/feature", Type: FastForwardUpdate},
+			{Ref: "refs/heads/master", Type: c.updateType},
+		}}
+
+		if err := DenyForcePush(h); (err != nil) != c.forceDenied {
+			t.Errorf("%s: expected DenyForcePush to deny it to be %v but got %v", c.updateType, c.forceDenied, err)
+		}
+
+		if err := DenyDeletes(h); (err != nil) != c.deleteDenied {
+			t.Errorf("%s: expected DenyDeletes to deny it to be %v but got %v", c.updateType, c.deleteDenied, err)
+		}
+	}
+}
+
+func Test_VerifyCommitSignatures(t *testing.T) {
+	repo, base := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	keyring, signed, badlySigned, unsigned := createSignedCommits(t, repo, base)
+	hook := VerifyCommitSignatures(keyring, "refs/heads/master")
+
+	cases := []struct {
+		update    RefUpdate
+		offending []string
+	}{
+		{RefUpdate{base, signed, "refs/heads/master", FastForwardUpdate}, nil},
+		{RefUpdate{base, badlySigned, "refs/heads/master", FastForwardUpdate}, []string{badlySigned}},
+		{RefUpdate{base, unsigned, "refs/heads/master", FastForwardUpdate}, []string{unsigned}},
+		{RefUpdate{base, unsigned, "refs/heads/feature", CreateUpdate}, nil},
+		{RefUpdate{base, zeroHash, "refs/heads/master", DeleteUpdate}, nil},
+	}
+
+	if err := VerifyCommitSignatures(nil)(&HookContext{FullRepoPath: repo, RefUpdates: []RefUpdate{{base, signed, "refs/heads/master", FastForwardUpdate}}}); err != errNoKeyring {
+		t.Errorf("expected a hook without a keyring to reject the push but got %v", err)
+	}
+
+	for _, c := range cases {
+		output := &bytes.Buffer{}
+		h := &HookContext{FullRepoPath: repo, RefUpdates: []RefUpdate{c.update}, w: output, capabilities: []string{"side-band-64k"}}
+
+		if err := hook(h); (err != nil) != (len(c.offending) > 0) {
+			t.Errorf("%s %s: expected rejected to be %v but got %v", c.update.Ref, c.update.New, len(c.offending) > 0, err)
+		}
+
+		for _, hash := range c.offending {
+			if !strings.Contains(output.String(), "\x03error: ") || !strings.Contains(output.String(), hash) {
+				t.Errorf("%s: expected %s to be listed in a fatal message but got %q", c.update.Ref, hash, output.String())
+			}
+		}
+
+		// only the bad commit is listed, not the signed one before it
+		if strings.Contains(output.String(), signed) {
+			t.Errorf("%s: expected the signed commit not to be listed but got %q", c.update.Ref, output.String())
+		}
+	}
+}
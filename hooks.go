@@ -0,0 +1,63 @@
+package gittp
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// repositoryHook runs the executable named hook in the repository's hooks directory, feeding it stdin and streaming everything it prints to the client as progress. Repositories without the hook, or with one that isn't executable, pass.
+func repositoryHook(h *HookContext, hook string, stdin []byte, args ...string) error {
+	hookPath := filepath.Join(h.FullRepoPath, "hooks", hook)
+	if info, err := os.Stat(hookPath); err != nil || info.IsDir() || info.Mode()&0111 == 0 {
+		return nil
+	}
+
+	cmd := exec.CommandContext(h.Context(), hookPath, args...)
+	killProcessGroup(cmd)
+	cmd.Dir = h.FullRepoPath
+	cmd.Stdin = bytes.NewReader(stdin)
+	cmd.Stdout = h
+	cmd.Stderr = h
+	cmd.Env = append(append(os.Environ(), h.objectEnv...), "GIT_DIR=.", "GITTP_REPOSITORY="+h.Repository)
+
+	if h.Principal != nil {
+		cmd.Env = append(cmd.Env, "REMOTE_USER="+h.Principal.Name)
+	}
+
+	if cert := h.PushCertificate; cert != nil {
+		status := "B"
+		if cert.Verified {
+			status = "G"
+		}
+
+		cmd.Env = append(cmd.Env,
+			"GIT_PUSH_CERT_SIGNER="+cert.Signer,
+			"GIT_PUSH_CERT_KEY="+cert.Key,
+			"GIT_PUSH_CERT_STATUS="+status,
+			"GIT_PUSH_CERT_NONCE="+cert.Nonce,
+			"GIT_PUSH_CERT_NONCE_STATUS="+string(cert.NonceStatus),
+		)
+	}
+
+	if len(h.PushOptions) > 0 {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_PUSH_OPTION_COUNT=%d", len(h.PushOptions)))
+		for i, option := range h.PushOptions {
+			cmd.Env = append(cmd.Env, fmt.Sprintf("GIT_PUSH_OPTION_%d=%s", i, option))
+		}
+	}
+
+	return cmd.Run()
+}
+
+// refUpdateLines formats ref updates the way git feeds them to pre-receive and post-receive hooks
+func refUpdateLines(updates []RefUpdate) []byte {
+	lines := &bytes.Buffer{}
+	for _, u := range updates {
+		fmt.Fprintf(lines, "%s %s %s\n", u.Old, u.New, u.Ref)
+	}
+
+	return lines.Bytes()
+}
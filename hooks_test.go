@@ -0,0 +1,61 @@
+package gittp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_repositoryHook(t *testing.T) {
+	repo, commit := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	hooks := filepath.Join(repo, "hooks")
+	ioutil.WriteFile(filepath.Join(hooks, "pre-receive"), []byte("#!/bin/sh\necho user=$REMOTE_USER\ncat\n"), 0755)
+	ioutil.WriteFile(filepath.Join(hooks, "update"), []byte("#!/bin/sh\necho declined $1 >&2\nexit 1\n"), 0755)
+	ioutil.WriteFile(filepath.Join(hooks, "post-receive"), []byte("#!/bin/sh\nexit 1\n"), 0644)
+
+	updates := []RefUpdate{{Old: zeroHash, New: commit, Ref: "refs/heads/master"}}
+
+	cases := []struct {
+		hook   string
+		stdin  []byte
+		args   []string
+		output string
+		fails  bool
+	}{
+		{"pre-receive", refUpdateLines(updates), nil, "user=adam\n" + zeroHash + " " + commit + " refs/heads/master\n", false},
+		{"update", nil, []string{"refs/heads/master", zeroHash, commit}, "declined refs/heads/master\n", true},
+		{"post-receive", refUpdateLines(updates), nil, "", false},
+		{"missing", nil, nil, "", false},
+	}
+
+	for _, c := range cases {
+		output := &bytes.Buffer{}
+		h := &HookContext{FullRepoPath: repo, Principal: &Principal{Name: "adam"}, w: output, capabilities: []string{"side-band-64k"}}
+
+		err := repositoryHook(h, c.hook, c.stdin, c.args...)
+		if (err != nil) != c.fails {
+			t.Errorf("%s: expected failure to be %v but got %v", c.hook, c.fails, err)
+		}
+
+		printed := &bytes.Buffer{}
+		for {
+			_, payload, err := readPktLine(output)
+			if err != nil || payload == nil {
+				break
+			}
+
+			if streamCode(payload[:1]) != progressStreamCode {
+				t.Errorf("%s: expected output to be sent as progress", c.hook)
+			}
+			printed.Write(payload[1:])
+		}
+
+		if printed.String() != c.output {
+			t.Errorf("%s: expected output %q but got %q", c.hook, c.output, printed.String())
+		}
+	}
+}
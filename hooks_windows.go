@@ -0,0 +1,6 @@
+package gittp
+
+import "os/exec"
+
+// killProcessGroup does nothing on windows, where only the hook process itself is killed
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,320 @@
+package gittp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	errMalformedToken    = errors.New("malformed token")
+	errUnknownSigningKey = errors.New("no key to verify the token with")
+	errBadSignature      = errors.New("token signature is invalid")
+	errTokenExpired      = errors.New("token is expired or not yet valid")
+	errWrongIssuer       = errors.New("token issuer or audience does not match")
+)
+
+// JWTAuthenticator authenticates requests carrying a signed JSON Web Token, either as a bearer token or as the password of HTTP Basic auth.
+//
+// The token's sub claim becomes the principal's name and every claim is available to hooks through Principal.Claims. A token with a repos claim, a list of repository globs, is limited to those repositories, with the access claim ("read" or "write", read by default) deciding what it can do with them.
+type JWTAuthenticator struct {
+	// Secret verifies tokens signed with HS256, HS384 or HS512
+	Secret []byte
+	// Keys verifies tokens signed with RS*, ES* or EdDSA, looked up by the token's kid header. Use LoadJWKS to read them from a JWKS file
+	Keys map[string]crypto.PublicKey
+	// Issuer, when set, must match the token's iss claim
+	Issuer string
+	// Audience, when set, must be one of the token's aud claim
+	Audience string
+	// Leeway is the clock skew allowed when checking the exp and nbf claims
+	Leeway time.Duration
+}
+
+// Authenticate verifies the token sent with the request
+func (j *JWTAuthenticator) Authenticate(req *http.Request) (*Principal, error) {
+	token := bearerToken(req)
+	if token == "" {
+		if _, password, ok := req.BasicAuth(); ok && strings.Count(password, ".") == 2 {
+			token = password
+		}
+	}
+
+	if token == "" {
+		return nil, nil
+	}
+
+	claims, err := j.verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return principalFromClaims(claims)
+}
+
+func principalFromClaims(claims map[string]interface{}) (*Principal, error) {
+	name, _ := claims["sub"].(string)
+	if name == "" {
+		return nil, errors.New("token has no sub claim")
+	}
+
+	principal := &Principal{Name: name, Claims: claims}
+
+	repos, ok := claims["repos"]
+	if !ok {
+		return principal, nil
+	}
+
+	access := ReadAccess
+	if claimed, _ := claims["access"].(string); claimed != "" {
+		access = Operation(claimed)
+	}
+
+	if access != ReadAccess && access != WriteAccess {
+		return nil, fmt.Errorf("token has an unknown access claim %s", access)
+	}
+
+	principal.Scope = AccessPolicy{}
+	for _, glob := range claimStrings(repos) {
+		principal.Scope = append(principal.Scope, AccessRule{"*", access, glob})
+	}
+
+	return principal, nil
+}
+
+// claimStrings reads a claim that can either be a single string or a list of them
+func claimStrings(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		values := []string{}
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+
+	return nil
+}
+
+func (j *JWTAuthenticator) verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+
+	header := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+
+	if err := j.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return nil, err
+	}
+
+	claims := map[string]interface{}{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(j.Leeway)) {
+		return nil, errTokenExpired
+	}
+
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(j.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errTokenExpired
+	}
+
+	if iss, _ := claims["iss"].(string); j.Issuer != "" && iss != j.Issuer {
+		return nil, errWrongIssuer
+	}
+
+	if j.Audience != "" {
+		found := false
+		for _, aud := range claimStrings(claims["aud"]) {
+			found = found || aud == j.Audience
+		}
+
+		if !found {
+			return nil, errWrongIssuer
+		}
+	}
+
+	return claims, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errMalformedToken
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		return errMalformedToken
+	}
+
+	return nil
+}
+
+func (j *JWTAuthenticator) verifySignature(alg, kid string, signed, signature []byte) error {
+	var newHash func() hash.Hash
+	var hashType crypto.Hash
+
+	switch alg {
+	case "HS256", "RS256", "ES256":
+		newHash, hashType = sha256.New, crypto.SHA256
+	case "HS384", "RS384", "ES384":
+		newHash, hashType = sha512.New384, crypto.SHA384
+	case "HS512", "RS512", "ES512":
+		newHash, hashType = sha512.New, crypto.SHA512
+	case "EdDSA":
+	default:
+		return fmt.Errorf("unsupported token algorithm %q", alg)
+	}
+
+	if strings.HasPrefix(alg, "HS") {
+		if len(j.Secret) == 0 {
+			return errUnknownSigningKey
+		}
+
+		mac := hmac.New(newHash, j.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errBadSignature
+		}
+
+		return nil
+	}
+
+	key, ok := j.Keys[kid]
+	if !ok && kid == "" && len(j.Keys) == 1 {
+		for _, k := range j.Keys {
+			key, ok = k, true
+		}
+	}
+
+	if !ok {
+		return errUnknownSigningKey
+	}
+
+	var digest []byte
+	if newHash != nil {
+		h := newHash()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+
+	valid := false
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		valid = strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hashType, digest, signature) == nil
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if strings.HasPrefix(alg, "ES") && len(signature) == 2*size {
+			r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+			valid = ecdsa.Verify(k, digest, r, s)
+		}
+	case ed25519.PublicKey:
+		valid = alg == "EdDSA" && ed25519.Verify(k, signed, signature)
+	}
+
+	if !valid {
+		return errBadSignature
+	}
+
+	return nil
+}
+
+// LoadJWKS reads the public keys in a JSON Web Key Set file, keyed by their kid. RSA, EC (P-256, P-384 and P-521) and Ed25519 keys are supported.
+func LoadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseJWKS(raw)
+}
+
+// ParseJWKS parses the public keys in a JSON Web Key Set
+func ParseJWKS(raw []byte) (map[string]crypto.PublicKey, error) {
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		var key crypto.PublicKey
+
+		switch jwk.Kty {
+		case "RSA":
+			n, nerr := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, eerr := base64.RawURLEncoding.DecodeString(jwk.E)
+			if nerr != nil || eerr != nil {
+				return nil, fmt.Errorf("key %s: malformed RSA key", jwk.Kid)
+			}
+
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case "EC":
+			curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+			curve, ok := curves[jwk.Crv]
+			x, xerr := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, yerr := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if !ok || xerr != nil || yerr != nil {
+				return nil, fmt.Errorf("key %s: malformed EC key", jwk.Kid)
+			}
+
+			key = &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if jwk.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("key %s: malformed OKP key", jwk.Kid)
+			}
+
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,113 @@
+package gittp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func signToken(t *testing.T, alg, kid string, claims map[string]interface{}, key interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, k, digest[:])
+		signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	default:
+		t.Fatal("unknown key type")
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func Test_JWTAuthenticator(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	jwks := fmt.Sprintf(`{"keys": [
+		{"kty": "RSA", "kid": "rsa", "n": %q, "e": %q},
+		{"kty": "EC", "kid": "ec", "crv": "P-256", "x": %q, "y": %q}
+	]}`,
+		base64.RawURLEncoding.EncodeToString(rsaKey.N.Bytes()),
+		base64.RawURLEncoding.EncodeToString(big.NewInt(int64(rsaKey.E)).Bytes()),
+		base64.RawURLEncoding.EncodeToString(ecKey.X.FillBytes(make([]byte, 32))),
+		base64.RawURLEncoding.EncodeToString(ecKey.Y.FillBytes(make([]byte, 32))))
+
+	keys, err := ParseJWKS([]byte(jwks))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	auth := &JWTAuthenticator{Secret: []byte("s3cr3t"), Keys: keys, Issuer: "ci"}
+
+	now := time.Now().Unix()
+	valid := map[string]interface{}{"sub": "pipeline-42", "iss": "ci", "exp": now + 60, "repos": []string{"team/*"}, "access": "write"}
+	expired := map[string]interface{}{"sub": "pipeline-42", "iss": "ci", "exp": now - 60}
+	wrongIssuer := map[string]interface{}{"sub": "pipeline-42", "iss": "someone", "exp": now + 60}
+
+	cases := []struct {
+		token string
+		valid bool
+	}{
+		{signToken(t, "HS256", "", valid, []byte("s3cr3t")), true},
+		{signToken(t, "RS256", "rsa", valid, rsaKey), true},
+		{signToken(t, "ES256", "ec", valid, ecKey), true},
+		{signToken(t, "HS256", "", valid, []byte("guess")), false},
+		{signToken(t, "RS256", "ec", valid, rsaKey), false},
+		{signToken(t, "HS256", "", expired, []byte("s3cr3t")), false},
+		{signToken(t, "HS256", "", wrongIssuer, []byte("s3cr3t")), false},
+		{"not.a.token", false},
+	}
+
+	for i, c := range cases {
+		req := createRequest("POST", "/team/api.git/git-receive-pack")
+		req.Header.Set("Authorization", "Bearer "+c.token)
+
+		principal, err := auth.Authenticate(req)
+		if !c.valid {
+			if err == nil || principal != nil {
+				t.Errorf("case %d: expected the token to be refused", i)
+			}
+			continue
+		}
+
+		if err != nil || principal == nil {
+			t.Errorf("case %d: expected the token to be accepted - actual %v", i, err)
+			continue
+		}
+
+		if principal.Name != "pipeline-42" || principal.Claims["iss"] != "ci" {
+			t.Errorf("case %d: unexpected principal %v", i, principal)
+		}
+
+		if !principal.Scope.Authorize(principal, "team/api.git", WriteAccess) || principal.Scope.Authorize(principal, "user/api.git", ReadAccess) {
+			t.Errorf("case %d: expected the token to be limited to team/*", i)
+		}
+	}
+
+	basic := createRequest("GET", "/team/api.git/info/refs?service=git-upload-pack")
+	basic.SetBasicAuth("x-token", signToken(t, "HS256", "", valid, []byte("s3cr3t")))
+	if principal, err := auth.Authenticate(basic); err != nil || principal == nil {
+		t.Errorf("expected a token in the basic auth password to be accepted - actual %v", err)
+	}
+}
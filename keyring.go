@@ -0,0 +1,115 @@
+package gittp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+var (
+	errUnknownSignatureFormat = errors.New("signature is not a GPG or SSH signature")
+	errInvalidSignature       = errors.New("signature could not be verified")
+	errNoAllowedSigners       = errors.New("no allowed signers file to verify SSH signatures with")
+	errNoKeyring              = errors.New("no keyring to verify signatures with")
+)
+
+// Keyring holds the public keys that signatures are verified against. GPG signatures are checked with gpg and SSH signatures with ssh-keygen, which need to be installed.
+type Keyring struct {
+	// GPGHome is a GnuPG home directory holding the keys GPG signatures are verified against. gpg's default home is used when it is empty.
+	GPGHome string
+	// AllowedSigners is an SSH allowed signers file, in the format of git's gpg.ssh.allowedSignersFile, listing the keys SSH signatures are verified against
+	AllowedSigners string
+}
+
+// Verify checks a detached GPG or SSH signature over payload, returning who made it and the fingerprint of their key. The signer is the user id of a GPG key or the principal of an SSH key.
+func (k *Keyring) Verify(ctx context.Context, payload, signature []byte) (signer, key string, err error) {
+	if k == nil {
+		return "", "", errNoKeyring
+	}
+
+	sig, err := ioutil.TempFile("", "gittp-signature")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(sig.Name())
+
+	_, err = sig.Write(signature)
+	sig.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	switch {
+	case bytes.HasPrefix(signature, []byte("-----BEGIN PGP SIGNATURE-----")):
+		return k.verifyGPG(ctx, payload, sig.Name())
+	case bytes.HasPrefix(signature, []byte("-----BEGIN SSH SIGNATURE-----")):
+		return k.verifySSH(ctx, payload, sig.Name())
+	default:
+		return "", "", errUnknownSignatureFormat
+	}
+}
+
+func (k *Keyring) verifyGPG(ctx context.Context, payload []byte, sigPath string) (signer, key string, err error) {
+	cmd := exec.CommandContext(ctx, "gpg", "--batch", "--no-tty", "--status-fd=1", "--verify", sigPath, "-")
+	cmd.Stdin = bytes.NewReader(payload)
+	if k.GPGHome != "" {
+		cmd.Env = append(os.Environ(), "GNUPGHOME="+k.GPGHome)
+	}
+
+	// gpg exits non zero for bad signatures, the status lines say why
+	output, _ := cmd.Output()
+
+	good := false
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.SplitN(strings.TrimPrefix(scanner.Text(), "[GNUPG:] "), " ", 3)
+
+		switch {
+		case fields[0] == "GOODSIG" && len(fields) == 3:
+			good, signer = true, fields[2]
+		case fields[0] == "VALIDSIG" && len(fields) > 1:
+			key = fields[1]
+		case fields[0] == "BADSIG" || fields[0] == "ERRSIG" || fields[0] == "EXPKEYSIG" || fields[0] == "REVKEYSIG":
+			return "", "", errInvalidSignature
+		}
+	}
+
+	if !good || key == "" {
+		return "", "", errInvalidSignature
+	}
+
+	return signer, key, nil
+}
+
+func (k *Keyring) verifySSH(ctx context.Context, payload []byte, sigPath string) (signer, key string, err error) {
+	if k.AllowedSigners == "" {
+		return "", "", errNoAllowedSigners
+	}
+
+	output, err := exec.CommandContext(ctx, "ssh-keygen", "-Y", "find-principals", "-f", k.AllowedSigners, "-s", sigPath).Output()
+	if err != nil {
+		return "", "", errInvalidSignature
+	}
+
+	principals := strings.Fields(string(output))
+	if len(principals) == 0 {
+		return "", "", errInvalidSignature
+	}
+
+	cmd := exec.CommandContext(ctx, "ssh-keygen", "-Y", "verify", "-f", k.AllowedSigners, "-I", principals[0], "-n", "git", "-s", sigPath)
+	cmd.Stdin = bytes.NewReader(payload)
+
+	// Good "git" signature for adam@example.com with ED25519 key SHA256:...
+	output, err = cmd.Output()
+	if err != nil || !bytes.HasPrefix(output, []byte("Good ")) {
+		return "", "", errInvalidSignature
+	}
+
+	fields := strings.Fields(string(output))
+	return principals[0], fields[len(fields)-1], nil
+}
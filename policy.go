@@ -0,0 +1,130 @@
+package gittp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// Operation is the kind of access a request needs to a repository
+type Operation string
+
+const (
+	// ReadAccess is needed to fetch and clone, git-upload-pack and dumb HTTP requests
+	ReadAccess Operation = "read"
+	// WriteAccess is needed to push, git-receive-pack requests. Write access implies read access.
+	WriteAccess Operation = "write"
+)
+
+// Authorizer decides who may read from and write to which repositories
+type Authorizer interface {
+	// Authorize returns true if principal may perform op on the repository. principal is nil for requests that did not authenticate.
+	Authorize(principal *Principal, repoName string, op Operation) bool
+}
+
+// AuthorizerFunc adapts a func into an Authorizer
+type AuthorizerFunc func(principal *Principal, repoName string, op Operation) bool
+
+// Authorize calls f(principal, repoName, op)
+func (f AuthorizerFunc) Authorize(principal *Principal, repoName string, op Operation) bool {
+	return f(principal, repoName, op)
+}
+
+// AccessRule grants a principal access to the repositories matching a glob
+type AccessRule struct {
+	// Who is the principal name this rule applies to. * matches any authenticated principal and @anonymous matches requests that did not authenticate.
+	Who string
+	// Access is the operation the rule grants
+	Access Operation
+	// Repositories is a glob in path.Match syntax, matched against the repository name. {user} is replaced with the name of the principal.
+	Repositories string
+}
+
+func (r AccessRule) matches(principal *Principal, repoName string, op Operation) bool {
+	if op == WriteAccess && r.Access != WriteAccess {
+		return false
+	}
+
+	name := ""
+	switch {
+	case principal == nil && r.Who != "@anonymous":
+		return false
+	case principal == nil:
+	case r.Who != "*" && r.Who != principal.Name:
+		return false
+	default:
+		name = principal.Name
+	}
+
+	if strings.Contains(r.Repositories, "{user}") && (name == "" || strings.ContainsAny(name, "/*?[\\")) {
+		return false
+	}
+
+	pattern := strings.Replace(r.Repositories, "{user}", name, -1)
+	matched, err := path.Match(pattern, repoName)
+	return err == nil && matched
+}
+
+// AccessPolicy is an Authorizer built from a list of rules. Access is denied unless a rule grants it.
+type AccessPolicy []AccessRule
+
+// Authorize returns true if any rule in the policy grants principal op on the repository
+func (p AccessPolicy) Authorize(principal *Principal, repoName string, op Operation) bool {
+	for _, rule := range p {
+		if rule.matches(principal, repoName, op) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadAccessPolicy reads a policy file. Each line has a principal, an access level and a repository glob separated by whitespace, and lines starting with # are comments:
+//
+//	# who        access  repositories
+//	@anonymous   read    public/*
+//	*            read    team/*
+//	*            write   user/{user}/*
+//	adam         write   team/*
+func LoadAccessPolicy(path string) (AccessPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseAccessPolicy(f)
+}
+
+// ParseAccessPolicy parses rules in the format described by LoadAccessPolicy
+func ParseAccessPolicy(r io.Reader) (AccessPolicy, error) {
+	policy := AccessPolicy{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("line %d: expected a principal, access and repository glob", line)
+		}
+
+		access := Operation(fields[1])
+		if access != ReadAccess && access != WriteAccess {
+			return nil, fmt.Errorf("line %d: access must be read or write, not %s", line, fields[1])
+		}
+
+		if _, err := path.Match(fields[2], ""); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		policy = append(policy, AccessRule{fields[0], access, fields[2]})
+	}
+
+	return policy, scanner.Err()
+}
@@ -0,0 +1,155 @@
+package gittp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_AccessPolicy(t *testing.T) {
+	policy, err := ParseAccessPolicy(strings.NewReader(`
+# who        access  repositories
+@anonymous   read    public/*
+*            read    team/*
+*            write   user/{user}/*
+adam         write   team/*
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adam, bob := &Principal{Name: "adam"}, &Principal{Name: "bob"}
+
+	cases := []struct {
+		principal *Principal
+		repoName  string
+		op        Operation
+		expected  bool
+	}{
+		{nil, "public/docs.git", ReadAccess, true},
+		{nil, "public/docs.git", WriteAccess, false},
+		{nil, "team/api.git", ReadAccess, false},
+		{bob, "team/api.git", ReadAccess, true},
+		{bob, "team/api.git", WriteAccess, false},
+		{adam, "team/api.git", WriteAccess, true},
+		{bob, "user/bob/dotfiles.git", WriteAccess, true},
+		{bob, "user/bob/dotfiles.git", ReadAccess, true},
+		{bob, "user/adam/dotfiles.git", ReadAccess, false},
+		{bob, "user/bob/nested/dotfiles.git", WriteAccess, false},
+		{adam, "public/docs.git", ReadAccess, false},
+	}
+
+	for _, c := range cases {
+		if actual := policy.Authorize(c.principal, c.repoName, c.op); actual != c.expected {
+			t.Errorf("%v %s %s expected %v - actual %v", c.principal, c.op, c.repoName, c.expected, actual)
+		}
+	}
+}
+
+func Test_ParseAccessPolicy_errors(t *testing.T) {
+	testCases := []string{
+		"adam write",
+		"adam admin team/*",
+		"adam read team/[",
+	}
+
+	for _, policy := range testCases {
+		if _, err := ParseAccessPolicy(strings.NewReader(policy)); err == nil {
+			t.Errorf("expected %q to fail to parse", policy)
+		}
+	}
+}
+
+func Test_gitHTTPServer_pathTraversal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gittp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	runGit(t, dir, "init", "-q", "--bare", filepath.Join(dir, "repositories", "secret.git"))
+
+	handler, err := NewGitServer(ServerConfig{
+		Path:       filepath.Join(dir, "repositories"),
+		Authorizer: AccessPolicy{{"@anonymous", ReadAccess, "team/*/*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]int{
+		"/secret.git/info/refs?service=git-upload-pack":              http.StatusUnauthorized,
+		"/team/../secret.git/info/refs?service=git-upload-pack":      http.StatusBadRequest,
+		"/team/x/../../secret.git/info/refs?service=git-upload-pack": http.StatusBadRequest,
+		"/team/../../secret.git/info/refs?service=git-upload-pack":   http.StatusBadRequest,
+		"/team/x/..%2f..%2fsecret.git/git-upload-pack":               http.StatusBadRequest,
+	}
+
+	for url, expected := range cases {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest("GET", url, nil))
+
+		if res.Code != expected {
+			t.Errorf("%s expected %d - actual %d", url, expected, res.Code)
+		}
+	}
+}
+
+func Test_gitHTTPServer_readersCannotCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gittp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the reader token is scoped to reading public/*, the writer token is not scoped at all
+	handler, err := NewGitServer(ServerConfig{
+		Path: dir,
+		Authenticator: AuthenticatorFunc(func(req *http.Request) (*Principal, error) {
+			switch req.Header.Get("Authorization") {
+			case "Bearer reader":
+				return &Principal{Name: "adam", Scope: AccessPolicy{{"adam", ReadAccess, "public/*"}}}, nil
+			case "Bearer writer":
+				return &Principal{Name: "adam"}, nil
+			}
+			return nil, nil
+		}),
+		Authorizer: AccessPolicy{{"@anonymous", ReadAccess, "public/*"}, {"adam", WriteAccess, "public/*"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		repoName string
+		token    string
+		expected int
+		created  bool
+	}{
+		{"public/anonymous.git", "", http.StatusNotFound, false},
+		{"public/reader.git", "reader", http.StatusNotFound, false},
+		{"public/writer.git", "writer", http.StatusOK, true},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/"+c.repoName+"/info/refs?service=git-upload-pack", nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+
+		if res.Code != c.expected {
+			t.Errorf("%s expected %d - actual %d", c.repoName, c.expected, res.Code)
+		}
+
+		if _, err := os.Stat(filepath.Join(dir, c.repoName)); (err == nil) != c.created {
+			t.Errorf("%s expected created to be %v", c.repoName, c.created)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package gittp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// ProtectionRule protects the refs matching a glob in the repositories matching a glob
+type ProtectionRule struct {
+	// Repositories is a glob in path.Match syntax, matched against the repository name
+	Repositories string
+	// Refs is a glob in path.Match syntax, matched against the full ref name, like refs/heads/release/*
+	Refs string
+	// DenyForcePush rejects updates that are not fast-forwards
+	DenyForcePush bool
+	// DenyDeletes rejects deleting the ref
+	DenyDeletes bool
+	// Pushers lists the principals allowed to update the ref. Anyone may update it when the list is empty.
+	Pushers []string
+	// RequireSignedCommits rejects updates that introduce commits without a signature from a key in Keyring
+	RequireSignedCommits bool
+	// Keyring holds the keys commit signatures are verified against when RequireSignedCommits is set
+	Keyring *Keyring
+}
+
+func (r ProtectionRule) matches(repoName, ref string) bool {
+	repoMatched, _ := path.Match(r.Repositories, repoName)
+	refMatched, _ := path.Match(r.Refs, ref)
+	return repoMatched && refMatched
+}
+
+// BranchProtection is a list of rules protecting refs from being rewritten, deleted or pushed to by the wrong people. Every rule matching a ref update applies to it.
+type BranchProtection []ProtectionRule
+
+// Update is an UpdateHook that rejects ref updates breaking any of the rules
+func (p BranchProtection) Update(h *HookContext, update RefUpdate) error {
+	for _, rule := range p {
+		if !rule.matches(h.Repository, update.Ref) {
+			continue
+		}
+
+		if err := rule.check(h, update); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (r ProtectionRule) check(h *HookContext, update RefUpdate) error {
+	if len(r.Pushers) > 0 {
+		allowed := false
+		for _, pusher := range r.Pushers {
+			allowed = allowed || (h.Principal != nil && h.Principal.Name == pusher)
+		}
+
+		if !allowed {
+			return fmt.Errorf("%s is protected, you may not push to it", update.Ref)
+		}
+	}
+
+	if r.DenyDeletes && update.Type == DeleteUpdate {
+		return fmt.Errorf("%s is protected from deletion", update.Ref)
+	}
+
+	if r.DenyForcePush && update.Type == ForceUpdate {
+		return fmt.Errorf("%s is protected from force pushes", update.Ref)
+	}
+
+	if r.RequireSignedCommits && update.Type != DeleteUpdate {
+		if r.Keyring == nil {
+			return fmt.Errorf("%s requires signed commits, but there are no keys to verify them with", update.Ref)
+		}
+
+		unverified, err := h.verifyCommits(r.Keyring, update)
+		if err != nil {
+			return err
+		}
+
+		if len(unverified) > 0 {
+			return fmt.Errorf("%s requires signed commits, %s: %s", update.Ref, unverified[0].Hash, unverified[0].Reason)
+		}
+	}
+
+	return nil
+}
+
+// LoadBranchProtection reads a branch protection rules file. Each line has a repository glob, a ref glob and the protections for the matching refs separated by whitespace, and lines starting with # are comments. The protections are no-force-push, no-delete, signed-commits and pushers= followed by a comma separated list of names:
+//
+//	# repositories  refs                  protections
+//	*               refs/heads/master     no-force-push no-delete
+//	team/*          refs/heads/release/*  no-force-push pushers=adam,bob signed-commits
+//
+// Signed commits are verified against keyring, which is needed by rules with signed-commits.
+func LoadBranchProtection(path string, keyring *Keyring) (BranchProtection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseBranchProtection(f, keyring)
+}
+
+// ParseBranchProtection parses rules in the format described by LoadBranchProtection
+func ParseBranchProtection(r io.Reader, keyring *Keyring) (BranchProtection, error) {
+	protection := BranchProtection{}
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %d: expected a repository glob, ref glob and protections", line)
+		}
+
+		for _, glob := range fields[:2] {
+			if _, err := path.Match(glob, ""); err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+		}
+
+		rule := ProtectionRule{Repositories: fields[0], Refs: fields[1]}
+		for _, protect := range fields[2:] {
+			switch {
+			case protect == "no-force-push":
+				rule.DenyForcePush = true
+			case protect == "no-delete":
+				rule.DenyDeletes = true
+			case protect == "signed-commits" && keyring == nil:
+				return nil, fmt.Errorf("line %d: signed-commits needs a keyring to verify signatures with", line)
+			case protect == "signed-commits":
+				rule.RequireSignedCommits, rule.Keyring = true, keyring
+			case strings.HasPrefix(protect, "pushers="):
+				rule.Pushers = strings.Split(strings.TrimPrefix(protect, "pushers="), ",")
+			default:
+				return nil, fmt.Errorf("line %d: unknown protection %s", line, protect)
+			}
+		}
+
+		protection = append(protection, rule)
+	}
+
+	return protection, scanner.Err()
+}
@@ -0,0 +1,61 @@
+package gittp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func Test_BranchProtection(t *testing.T) {
+	repo, base := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	keyring, signed, badlySigned, unsigned := createSignedCommits(t, repo, base)
+
+	protection, err := ParseBranchProtection(strings.NewReader(`
+# repositories  refs                  protections
+*               refs/heads/master     no-force-push no-delete
+team/*          refs/heads/release/*  pushers=adam,bob signed-commits
+`), keyring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	adam, eve := &Principal{Name: "adam"}, &Principal{Name: "eve"}
+
+	cases := []struct {
+		repoName  string
+		principal *Principal
+		update    RefUpdate
+		allowed   bool
+	}{
+		{"repo.git", nil, RefUpdate{base, unsigned, "refs/heads/master", FastForwardUpdate}, true},
+		{"repo.git", nil, RefUpdate{unsigned, signed, "refs/heads/master", ForceUpdate}, false},
+		{"repo.git", nil, RefUpdate{base, zeroHash, "refs/heads/master", DeleteUpdate}, false},
+		{"repo.git", nil, RefUpdate{unsigned, signed, "refs/heads/feature", ForceUpdate}, true},
+		{"repo.git", nil, RefUpdate{zeroHash, unsigned, "refs/heads/release/1", CreateUpdate}, true},
+		{"team/repo.git", eve, RefUpdate{base, signed, "refs/heads/release/1", FastForwardUpdate}, false},
+		{"team/repo.git", nil, RefUpdate{base, signed, "refs/heads/release/1", FastForwardUpdate}, false},
+		{"team/repo.git", adam, RefUpdate{base, signed, "refs/heads/release/1", FastForwardUpdate}, true},
+		{"team/repo.git", adam, RefUpdate{base, unsigned, "refs/heads/release/1", FastForwardUpdate}, false},
+		{"team/repo.git", adam, RefUpdate{base, badlySigned, "refs/heads/release/1", FastForwardUpdate}, false},
+	}
+
+	for _, c := range cases {
+		h := &HookContext{Repository: c.repoName, FullRepoPath: repo, Principal: c.principal, RefUpdates: []RefUpdate{c.update}}
+
+		err := protection.Update(h, c.update)
+		if (err == nil) != c.allowed {
+			t.Errorf("%s %s %v: expected allowed to be %v but got %v", c.repoName, c.update.Ref, c.principal, c.allowed, err)
+		}
+	}
+
+	if _, err := ParseBranchProtection(strings.NewReader("* refs/heads/master no-rebase\n"), nil); err == nil {
+		t.Error("expected an unknown protection to be an error")
+	}
+
+	if _, err := ParseBranchProtection(strings.NewReader("* refs/heads/master signed-commits\n"), nil); err == nil {
+		t.Error("expected signed-commits without a keyring to be an error")
+	}
+}
@@ -0,0 +1,296 @@
+package gittp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	errFunnyRefname      = errors.New("funny refname")
+	errFailedToUpdateRef = errors.New("failed to update ref")
+	errFailedToDeleteRef = errors.New("failed to delete")
+	errAtomicTransaction = errors.New("atomic transaction failed")
+)
+
+// receiveConfig is the part of a repository's config that changes how a push is received
+type receiveConfig struct {
+	denyDeletes         bool
+	denyNonFastForwards bool
+	fsckObjects         bool
+	autoGC              bool
+	unpackLimit         int
+}
+
+// readReceiveConfig reads the receive.* settings of a repository, falling back to transfer.* and then git's defaults
+func readReceiveConfig(ctx context.Context, fullRepoPath string) receiveConfig {
+	config := receiveConfig{autoGC: true, unpackLimit: 100}
+
+	cmd := exec.CommandContext(ctx, "git", "config", "-z", "--get-regexp", `^(receive|transfer)\.`)
+	cmd.Dir = fullRepoPath
+	out, _ := cmd.Output()
+
+	values := map[string]string{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		if entry == "" {
+			continue
+		}
+
+		// a key without a value is set to true
+		key, value := entry, "true"
+		if i := strings.IndexByte(entry, '\n'); i >= 0 {
+			key, value = entry[:i], entry[i+1:]
+		}
+		values[strings.ToLower(key)] = value
+	}
+
+	lookup := func(keys ...string) (string, bool) {
+		for _, key := range keys {
+			if value, ok := values[strings.ToLower(key)]; ok {
+				return value, true
+			}
+		}
+		return "", false
+	}
+
+	boolean := func(fallback bool, keys ...string) bool {
+		value, ok := lookup(keys...)
+		if !ok {
+			return fallback
+		}
+
+		switch strings.ToLower(value) {
+		case "true", "yes", "on", "1":
+			return true
+		case "false", "no", "off", "0", "":
+			return false
+		}
+		return fallback
+	}
+
+	config.denyDeletes = boolean(false, "receive.denyDeletes")
+	config.denyNonFastForwards = boolean(false, "receive.denyNonFastForwards")
+	config.fsckObjects = boolean(false, "receive.fsckObjects", "transfer.fsckObjects")
+	config.autoGC = boolean(true, "receive.autogc")
+
+	if value, ok := lookup("receive.unpackLimit", "transfer.unpackLimit"); ok {
+		if limit, err := strconv.Atoi(value); err == nil {
+			config.unpackLimit = limit
+		}
+	}
+
+	return config
+}
+
+// deny gives the reason the config refuses an update, if it does
+func (c receiveConfig) deny(update RefUpdate) string {
+	if c.denyDeletes && update.Type == DeleteUpdate {
+		return "deletion prohibited"
+	}
+
+	if c.denyNonFastForwards && update.Type == ForceUpdate {
+		return "non-fast-forward"
+	}
+
+	return ""
+}
+
+// quarantine holds the objects of an incoming push apart from the repository's own objects, so that hooks can look at them before the push is accepted
+type quarantine struct {
+	dir string
+}
+
+// newQuarantine unpacks or indexes the pack sent with a push into a temporary object directory inside the repository, following receive.unpackLimit and receive.fsckObjects
+func newQuarantine(ctx context.Context, fullRepoPath string, pack io.Reader, config receiveConfig) (*quarantine, error) {
+	dir, err := ioutil.TempDir(filepath.Join(fullRepoPath, "objects"), "incoming-")
+	if err != nil {
+		return nil, err
+	}
+
+	q := &quarantine{dir: dir}
+
+	if err := os.Mkdir(filepath.Join(dir, "pack"), os.ModePerm|os.ModeDir); err != nil {
+		q.Close()
+		return nil, err
+	}
+
+	// the pack header ends with how many objects are in it
+	r := bufio.NewReader(pack)
+	args := []string{"index-pack", "--stdin", "--fix-thin"}
+	if header, err := r.Peek(12); err == nil && string(header[:4]) == "PACK" && int64(binary.BigEndian.Uint32(header[8:])) < int64(config.unpackLimit) {
+		args = []string{"unpack-objects", "-q"}
+	}
+
+	if config.fsckObjects {
+		args = append(args, "--strict")
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = fullRepoPath
+	cmd.Env = append(os.Environ(), q.env(fullRepoPath)...)
+	cmd.Stdin = r
+
+	if err := cmd.Run(); err != nil {
+		q.Close()
+		return nil, fmt.Errorf("%s abnormal exit", args[0])
+	}
+
+	return q, nil
+}
+
+// env points git at the quarantined objects, falling back to the repository's objects. GIT_QUARANTINE_PATH tells git that refs must not be updated while it is set, as they would point at objects that may be thrown away.
+func (q *quarantine) env(fullRepoPath string) []string {
+	return []string{
+		"GIT_QUARANTINE_PATH=" + q.dir,
+		"GIT_OBJECT_DIRECTORY=" + q.dir,
+		"GIT_ALTERNATE_OBJECT_DIRECTORIES=" + filepath.Join(fullRepoPath, "objects"),
+	}
+}
+
+// connected returns true if every object reachable from the updated refs is either quarantined or already in the repository
+func (q *quarantine) connected(ctx context.Context, fullRepoPath string, updates []RefUpdate) bool {
+	revisions := &strings.Builder{}
+	for _, u := range updates {
+		if u.New != zeroHash {
+			revisions.WriteString(u.New + "\n")
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "rev-list", "--objects", "--quiet", "--stdin", "--not", "--all")
+	cmd.Dir = fullRepoPath
+	cmd.Env = append(os.Environ(), q.env(fullRepoPath)...)
+	cmd.Stdin = strings.NewReader(revisions.String())
+
+	return cmd.Run() == nil
+}
+
+// migrate moves the quarantined objects into the repository. Within each directory packs are moved ahead of their indexes, so the repository never finds an index without its pack.
+func (q *quarantine) migrate(fullRepoPath string) error {
+	objects := filepath.Join(fullRepoPath, "objects")
+
+	dirs, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(q.dir, dir.Name()))
+		if err != nil {
+			return err
+		}
+
+		sort.SliceStable(files, func(i, j int) bool {
+			return !strings.HasSuffix(files[i].Name(), ".idx") && strings.HasSuffix(files[j].Name(), ".idx")
+		})
+
+		if err := os.MkdirAll(filepath.Join(objects, dir.Name()), os.ModePerm|os.ModeDir); err != nil {
+			return err
+		}
+
+		for _, file := range files {
+			src, dst := filepath.Join(q.dir, dir.Name(), file.Name()), filepath.Join(objects, dir.Name(), file.Name())
+
+			// objects are named after their content, so one that already exists is the same object
+			if _, err := os.Stat(dst); err == nil {
+				continue
+			}
+
+			if err := os.Rename(src, dst); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close throws away whatever is left in the quarantine
+func (q *quarantine) Close() error {
+	return os.RemoveAll(q.dir)
+}
+
+// sendsPack returns true if any of the updates need objects, pushes that only delete refs come without a pack
+func sendsPack(updates []RefUpdate) bool {
+	for _, u := range updates {
+		if u.New != zeroHash {
+			return true
+		}
+	}
+
+	return false
+}
+
+// updateRef points a ref at the new side of update, or deletes it, as long as it still points at the old side
+func updateRef(ctx context.Context, fullRepoPath string, update RefUpdate) error {
+	if !validRefName(ctx, update.Ref) {
+		return errFunnyRefname
+	}
+
+	args, failure := []string{"update-ref", "-m", "push", update.Ref, update.New, update.Old}, errFailedToUpdateRef
+	if update.New == zeroHash {
+		args, failure = []string{"update-ref", "-m", "push", "-d", update.Ref, update.Old}, errFailedToDeleteRef
+	}
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = fullRepoPath
+
+	if err := cmd.Run(); err != nil {
+		return failure
+	}
+
+	return nil
+}
+
+// updateRefs updates every ref in a single transaction for atomic pushes, so either all of them move or none do
+func updateRefs(ctx context.Context, fullRepoPath string, updates []RefUpdate) error {
+	commands := &bytes.Buffer{}
+	for _, update := range updates {
+		if !validRefName(ctx, update.Ref) {
+			return errFunnyRefname
+		}
+
+		if update.New == zeroHash {
+			fmt.Fprintf(commands, "delete %s %s\n", update.Ref, update.Old)
+		} else {
+			fmt.Fprintf(commands, "update %s %s %s\n", update.Ref, update.New, update.Old)
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, "git", "update-ref", "-m", "push", "--stdin")
+	cmd.Dir = fullRepoPath
+	cmd.Stdin = commands
+
+	if err := cmd.Run(); err != nil {
+		return errAtomicTransaction
+	}
+
+	return nil
+}
+
+// validRefName is true for refs under refs/ that git would accept
+func validRefName(ctx context.Context, ref string) bool {
+	return strings.HasPrefix(ref, "refs/") && exec.CommandContext(ctx, "git", "check-ref-format", ref).Run() == nil
+}
+
+// gcAuto lets git repack and prune the repository if enough loose objects and packs have built up, the way receive-pack does after a push
+func gcAuto(ctx context.Context, fullRepoPath string) error {
+	cmd := exec.CommandContext(ctx, "git", "gc", "--auto", "--quiet")
+	cmd.Dir = fullRepoPath
+
+	return cmd.Run()
+}
@@ -0,0 +1,168 @@
+package gittp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func Test_quarantine(t *testing.T) {
+	repo, base := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	work := filepath.Join(filepath.Dir(repo), "clone")
+	runGit(t, filepath.Dir(repo), "clone", "-q", repo, work)
+
+	ioutil.WriteFile(filepath.Join(work, "main.go"), []byte("package main\n"), 0644)
+	runGit(t, work, "add", ".")
+	runGit(t, work, "commit", "-q", "-m", "second commit")
+	head := runGit(t, work, "rev-parse", "HEAD")
+
+	cmd := exec.Command("git", "pack-objects", "--stdout", "--revs", "--thin")
+	cmd.Dir = work
+	cmd.Stdin = bytes.NewBufferString(head + "\n^" + base + "\n")
+	pack, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	update := RefUpdate{Old: base, New: head, Ref: "refs/heads/master"}
+
+	if _, err := newQuarantine(context.Background(), repo, bytes.NewReader(pack[:len(pack)-20]), receiveConfig{unpackLimit: 100}); err == nil || err.Error() != "unpack-objects abnormal exit" {
+		t.Errorf("expected a truncated pack to fail to unpack but got %v", err)
+	}
+
+	// small packs are unpacked into loose objects
+	rejected, err := newQuarantine(context.Background(), repo, bytes.NewReader(pack), receiveConfig{unpackLimit: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !rejected.connected(context.Background(), repo, []RefUpdate{update}) {
+		t.Error("expected the pushed commit to be connected to the repository")
+	}
+
+	if rejected.connected(context.Background(), repo, []RefUpdate{{Old: base, New: "1234567890123456789012345678901234567890", Ref: "refs/heads/master"}}) {
+		t.Error("expected a missing commit not to be connected")
+	}
+
+	rejected.Close()
+
+	if exec.Command("git", "-C", repo, "cat-file", "-e", head).Run() == nil {
+		t.Error("expected the objects of a rejected push to be thrown away")
+	}
+
+	// and bigger ones are kept as a pack
+	accepted, err := newQuarantine(context.Background(), repo, bytes.NewReader(pack), receiveConfig{unpackLimit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	if err := accepted.migrate(repo); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := exec.Command("git", "-C", repo, "cat-file", "-e", head).Run(); err != nil {
+		t.Error("expected the objects of an accepted push to be moved into the repository", err)
+	}
+
+	if err := updateRef(context.Background(), repo, RefUpdate{Old: head, New: base, Ref: "refs/heads/master"}); err != errFailedToUpdateRef {
+		t.Errorf("expected a stale update to fail but got %v", err)
+	}
+
+	if err := updateRef(context.Background(), repo, RefUpdate{Old: zeroHash, New: head, Ref: "master"}); err != errFunnyRefname {
+		t.Errorf("expected a ref outside of refs/ to be refused but got %v", err)
+	}
+
+	if err := updateRef(context.Background(), repo, update); err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := runGit(t, repo, "rev-parse", "refs/heads/master"); actual != head {
+		t.Errorf("expected master to be updated to %s but got %s", head, actual)
+	}
+
+	if err := updateRef(context.Background(), repo, RefUpdate{Old: head, New: zeroHash, Ref: "refs/heads/master"}); err != nil {
+		t.Errorf("expected master to be deleted but got %v", err)
+	}
+}
+
+func Test_updateRefs(t *testing.T) {
+	repo, base := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	runGit(t, repo, "update-ref", "refs/heads/feature", base)
+
+	cases := []struct {
+		updates  []RefUpdate
+		expected error
+	}{
+		{[]RefUpdate{{Old: zeroHash, New: base, Ref: "refs/tags/v1"}, {Old: zeroHash, New: base, Ref: "refs/heads/feature"}}, errAtomicTransaction},
+		{[]RefUpdate{{Old: zeroHash, New: base, Ref: "refs/tags/v1"}, {Old: zeroHash, New: base, Ref: "v2"}}, errFunnyRefname},
+		{[]RefUpdate{{Old: zeroHash, New: base, Ref: "refs/tags/v1"}, {Old: base, New: zeroHash, Ref: "refs/heads/feature"}}, nil},
+	}
+
+	for _, c := range cases {
+		if err := updateRefs(context.Background(), repo, c.updates); err != c.expected {
+			t.Errorf("%v: expected %v but got %v", c.updates, c.expected, err)
+		}
+
+		// nothing moves unless everything does
+		created := exec.Command("git", "-C", repo, "rev-parse", "--verify", "-q", "refs/tags/v1").Run() == nil
+		if created != (c.expected == nil) {
+			t.Errorf("%v: expected refs/tags/v1 to be created to be %v", c.updates, c.expected == nil)
+		}
+	}
+
+	if err := exec.Command("git", "-C", repo, "rev-parse", "--verify", "-q", "refs/heads/feature").Run(); err == nil {
+		t.Error("expected refs/heads/feature to be deleted")
+	}
+}
+
+func Test_readReceiveConfig(t *testing.T) {
+	repo, _ := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	if actual := readReceiveConfig(context.Background(), repo); actual != (receiveConfig{autoGC: true, unpackLimit: 100}) {
+		t.Errorf("expected git's defaults but got %+v", actual)
+	}
+
+	runGit(t, repo, "config", "receive.denyDeletes", "true")
+	runGit(t, repo, "config", "receive.denyNonFastForwards", "yes")
+	runGit(t, repo, "config", "transfer.fsckObjects", "on")
+	runGit(t, repo, "config", "transfer.unpackLimit", "10")
+	runGit(t, repo, "config", "receive.unpackLimit", "1")
+	runGit(t, repo, "config", "receive.autogc", "false")
+
+	expected := receiveConfig{denyDeletes: true, denyNonFastForwards: true, fsckObjects: true, unpackLimit: 1}
+	if actual := readReceiveConfig(context.Background(), repo); actual != expected {
+		t.Errorf("expected %+v but got %+v", expected, actual)
+	}
+}
+
+func Test_receiveConfig_deny(t *testing.T) {
+	config := receiveConfig{denyDeletes: true, denyNonFastForwards: true}
+
+	cases := []struct {
+		config   receiveConfig
+		update   RefUpdate
+		expected string
+	}{
+		{receiveConfig{}, RefUpdate{Type: DeleteUpdate}, ""},
+		{receiveConfig{}, RefUpdate{Type: ForceUpdate}, ""},
+		{config, RefUpdate{Type: DeleteUpdate}, "deletion prohibited"},
+		{config, RefUpdate{Type: ForceUpdate}, "non-fast-forward"},
+		{config, RefUpdate{Type: FastForwardUpdate}, ""},
+	}
+
+	for _, c := range cases {
+		if actual := c.config.deny(c.update); actual != c.expected {
+			t.Errorf("%+v %v: expected %q but got %q", c.config, c.update.Type, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,451 @@
+package gittp
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errQueueClosed = errors.New("job queue is closed")
+
+// PostReceiveJob is a func ran by a JobQueue for each push that was accepted. Returning an error, or panicking, fails the attempt and the job is tried again after a backoff.
+type PostReceiveJob func(*HookContext) error
+
+// JobState is where a job is in its lifecycle
+type JobState string
+
+const (
+	// JobPending jobs are waiting for a worker, either for the first time or for another attempt
+	JobPending JobState = "pending"
+	// JobRunning jobs are being worked on
+	JobRunning JobState = "running"
+	// JobSucceeded jobs finished without an error
+	JobSucceeded JobState = "succeeded"
+	// JobFailed jobs ran out of attempts
+	JobFailed JobState = "failed"
+)
+
+// Job is the post receive work for a single push. Only the name of whoever pushed is kept, so background attempts see a Principal without Claims or a Scope.
+type Job struct {
+	ID          string      `json:"id"`
+	Repository  string      `json:"repository"`
+	RefUpdates  []RefUpdate `json:"ref_updates"`
+	Pusher      string      `json:"pusher,omitempty"`
+	PushOptions []string    `json:"push_options,omitempty"`
+	State       JobState    `json:"state"`
+	Attempts    int         `json:"attempts"`
+	LastError   string      `json:"last_error,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+	UpdatedAt   time.Time   `json:"updated_at"`
+	NextAttempt time.Time   `json:"next_attempt,omitempty"`
+}
+
+// JobQueueConfig is a configuration object for NewJobQueue
+type JobQueueConfig struct {
+	// Path is the directory jobs are stored in, so they survive restarts
+	Path string
+
+	// Repositories is where the server keeps its repositories, the same as ServerConfig.Path. Jobs only store the name of their repository and find it in here.
+	Repositories string
+
+	// Handler is ran for every job
+	Handler PostReceiveJob
+
+	// Workers is how many jobs can run at the same time. Defaults to 1
+	Workers int
+
+	// MaxAttempts is how many times a job is tried before it is marked as failed. Defaults to 5
+	MaxAttempts int
+
+	// Backoff is how long to wait before trying a failed job again, doubling after each attempt. Defaults to one second
+	Backoff time.Duration
+
+	// Retention is how long succeeded and failed jobs are kept, on disk and in the status API, after they finish. Defaults to a week
+	Retention time.Duration
+
+	// Synchronous runs the first attempt of each job while the client waits on the push, so the handler can write progress back to it. Later attempts still happen in the background.
+	Synchronous bool
+
+	// Enables debug logging
+	Debug bool
+}
+
+// JobQueue runs post receive work in the background with a pool of workers, retrying failed jobs with exponential backoff. Jobs are persisted to disk so that pending work is picked back up after a restart.
+//
+// JobQueue is also an http.Handler serving the status of jobs as JSON: GET / lists every job and GET /{id} returns a single job.
+type JobQueue struct {
+	config JobQueueConfig
+	mu     sync.Mutex
+	jobs   map[string]*Job
+	work   chan string
+	quit   chan struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewJobQueue creates a JobQueue, loading any jobs already stored at config.Path and starting its workers
+func NewJobQueue(config JobQueueConfig) (*JobQueue, error) {
+	if config.Handler == nil {
+		return nil, errors.New("a job queue needs a handler")
+	}
+
+	if config.Repositories == "" {
+		return nil, errors.New("a job queue needs the path repositories are stored in")
+	}
+
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+
+	if config.MaxAttempts <= 0 {
+		config.MaxAttempts = 5
+	}
+
+	if config.Backoff <= 0 {
+		config.Backoff = time.Second
+	}
+
+	if config.Retention <= 0 {
+		config.Retention = 7 * 24 * time.Hour
+	}
+
+	config.Path, _ = filepath.Abs(config.Path)
+	config.Repositories, _ = filepath.Abs(config.Repositories)
+	if err := os.MkdirAll(config.Path, os.ModeDir|os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	q := &JobQueue{
+		config: config,
+		jobs:   map[string]*Job{},
+		work:   make(chan string),
+		quit:   make(chan struct{}),
+	}
+
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	q.prune()
+
+	for i := 0; i < config.Workers; i++ {
+		q.wg.Add(1)
+		go q.worker()
+	}
+
+	for _, job := range q.jobs {
+		if job.State == JobPending {
+			q.schedule(job.ID, job.NextAttempt)
+		}
+	}
+
+	return q, nil
+}
+
+// Enqueue adds a job for the push described by h. If the queue is Synchronous the first attempt runs before Enqueue returns, with progress written to h.
+func (q *JobQueue) Enqueue(h *HookContext) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+
+	now := time.Now().UTC()
+	job := &Job{
+		ID:          id,
+		Repository:  h.Repository,
+		RefUpdates:  h.RefUpdates,
+		PushOptions: h.PushOptions,
+		State:       JobPending,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+
+	if h.Principal != nil {
+		job.Pusher = h.Principal.Name
+	}
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return Job{}, errQueueClosed
+	}
+
+	q.jobs[id] = job
+	err = q.save(job)
+	q.mu.Unlock()
+
+	if err != nil {
+		return Job{}, err
+	}
+
+	if q.config.Synchronous {
+		q.attempt(id, h)
+	} else {
+		q.schedule(id, time.Time{})
+	}
+
+	// the job may already be finished and pruned
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return *job, nil
+}
+
+// Job returns the job with the given id
+func (q *JobQueue) Job(id string) (Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("no job with id %s", id)
+	}
+
+	return *job, nil
+}
+
+// Jobs returns every job the queue knows about, oldest first
+func (q *JobQueue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, job := range q.jobs {
+		jobs = append(jobs, *job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+	return jobs
+}
+
+// Close stops the workers, waiting for jobs that are running to finish. Pending jobs stay on disk for the next JobQueue to pick up.
+func (q *JobQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+
+	q.closed = true
+	close(q.quit)
+	q.mu.Unlock()
+
+	q.wg.Wait()
+	return nil
+}
+
+func (q *JobQueue) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		res.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body interface{}
+
+	id := strings.Trim(req.URL.Path, "/")
+	if id == "" {
+		body = q.Jobs()
+	} else if job, err := q.Job(id); err == nil {
+		body = job
+	} else {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(body)
+}
+
+// schedule hands the job to a worker once at has passed
+func (q *JobQueue) schedule(id string, at time.Time) {
+	send := func() {
+		select {
+		case q.work <- id:
+		case <-q.quit:
+		}
+	}
+
+	if delay := time.Until(at); delay > 0 {
+		time.AfterFunc(delay, send)
+	} else {
+		go send()
+	}
+}
+
+func (q *JobQueue) worker() {
+	defer q.wg.Done()
+
+	for {
+		select {
+		case id := <-q.work:
+			q.attempt(id, nil)
+		case <-q.quit:
+			return
+		}
+	}
+}
+
+// attempt runs the handler for a job once, scheduling another attempt if it fails. h is the context of the push when the job runs synchronously, and nil when it runs in the background.
+func (q *JobQueue) attempt(id string, h *HookContext) {
+	q.mu.Lock()
+	job, ok := q.jobs[id]
+	if !ok || job.State != JobPending {
+		q.mu.Unlock()
+		return
+	}
+
+	job.State = JobRunning
+	job.Attempts++
+	job.UpdatedAt = time.Now().UTC()
+	q.save(job)
+
+	if h == nil {
+		h = job.hookContext(q.config.Repositories)
+	}
+	q.mu.Unlock()
+
+	err := q.run(h)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job.UpdatedAt = time.Now().UTC()
+	job.LastError = ""
+
+	switch {
+	case err == nil:
+		job.State = JobSucceeded
+	case job.Attempts >= q.config.MaxAttempts:
+		job.State = JobFailed
+		job.LastError = err.Error()
+	default:
+		job.State = JobPending
+		job.LastError = err.Error()
+		job.NextAttempt = job.UpdatedAt.Add(q.config.Backoff << uint(job.Attempts-1))
+		q.schedule(job.ID, job.NextAttempt)
+	}
+
+	if err != nil && q.config.Debug {
+		log.Println("post receive job", job.ID, "failed attempt", job.Attempts, err)
+	}
+
+	if serr := q.save(job); serr != nil && q.config.Debug {
+		log.Println("could not save job", job.ID, serr)
+	}
+
+	q.prune()
+}
+
+// prune forgets the jobs that finished longer than Retention ago, deleting them from disk. q.mu must be held.
+func (q *JobQueue) prune() {
+	cutoff := time.Now().UTC().Add(-q.config.Retention)
+
+	for id, job := range q.jobs {
+		if (job.State != JobSucceeded && job.State != JobFailed) || job.UpdatedAt.After(cutoff) {
+			continue
+		}
+
+		if err := os.Remove(filepath.Join(q.config.Path, id+".json")); err != nil && !os.IsNotExist(err) {
+			if q.config.Debug {
+				log.Println("could not delete job", id, err)
+			}
+			continue
+		}
+
+		delete(q.jobs, id)
+	}
+}
+
+// run calls the handler, turning a panic into an error
+func (q *JobQueue) run(h *HookContext) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+
+	return q.config.Handler(h)
+}
+
+func (q *JobQueue) save(job *Job) error {
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(q.config.Path, job.ID+".json")
+	if err := ioutil.WriteFile(path+".tmp", raw, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+func (q *JobQueue) load() error {
+	paths, err := filepath.Glob(filepath.Join(q.config.Path, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range paths {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		job := &Job{}
+		if err := json.Unmarshal(raw, job); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		// the process went away in the middle of this job, so it has to run again
+		if job.State == JobRunning {
+			job.State = JobPending
+		}
+
+		q.jobs[job.ID] = job
+	}
+
+	return nil
+}
+
+// hookContext rebuilds the context of the push for a background attempt, finding the repository in repositories
+func (j *Job) hookContext(repositories string) *HookContext {
+	h := &HookContext{
+		Repository:   j.Repository,
+		FullRepoPath: filepath.Join(repositories, j.Repository),
+		RefUpdates:   j.RefUpdates,
+		RepoExists:   true,
+		PushOptions:  j.PushOptions,
+		w:            ioutil.Discard,
+	}
+
+	if j.Pusher != "" {
+		h.Principal = &Principal{Name: j.Pusher}
+	}
+
+	if len(j.RefUpdates) > 0 {
+		h.Branch, h.Commit = j.RefUpdates[0].Ref, j.RefUpdates[0].New
+	}
+
+	return h
+}
+
+func newJobID() (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix)), nil
+}
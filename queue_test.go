@@ -0,0 +1,244 @@
+package gittp
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitForJob(t *testing.T, q *JobQueue, id string, state JobState) Job {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if job, err := q.Job(id); err == nil && job.State == state {
+			return job
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	job, _ := q.Job(id)
+	t.Fatalf("expected job %s to be %s - actual %s", id, state, job.State)
+	return job
+}
+
+func Test_JobQueue_retries(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gittp")
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	q, err := NewJobQueue(JobQueueConfig{
+		Path:         dir,
+		Repositories: dir,
+		Backoff:      time.Millisecond,
+		Handler: func(h *HookContext) error {
+			if atomic.AddInt32(&calls, 1) < 3 {
+				return errors.New("build server is down")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	job, err := q.Enqueue(&HookContext{Repository: "adam/test.git", RefUpdates: []RefUpdate{{Ref: "refs/heads/master"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job = waitForJob(t, q, job.ID, JobSucceeded)
+	if job.Attempts != 3 || job.LastError != "" {
+		t.Errorf("expected 3 attempts and no error - actual %d %q", job.Attempts, job.LastError)
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, job.ID+".json"))
+	if err != nil || !strings.Contains(string(raw), `"succeeded"`) {
+		t.Errorf("expected the job to be saved to disk - actual %v %s", err, raw)
+	}
+}
+
+func Test_JobQueue_panics(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gittp")
+	defer os.RemoveAll(dir)
+
+	q, err := NewJobQueue(JobQueueConfig{
+		Path:         dir,
+		Repositories: dir,
+		Backoff:      time.Millisecond,
+		MaxAttempts:  2,
+		Handler:      func(h *HookContext) error { panic("oh no") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	job, _ := q.Enqueue(&HookContext{Repository: "adam/test.git"})
+	job = waitForJob(t, q, job.ID, JobFailed)
+
+	if job.Attempts != 2 || !strings.Contains(job.LastError, "oh no") {
+		t.Errorf("expected 2 attempts and the panic as the error - actual %d %q", job.Attempts, job.LastError)
+	}
+}
+
+func Test_JobQueue_resumesPendingJobs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gittp")
+	defer os.RemoveAll(dir)
+
+	pending := Job{ID: "1-abcd", Repository: "adam/test.git", Pusher: "adam", State: JobRunning, Attempts: 1}
+	raw, _ := json.Marshal(pending)
+	ioutil.WriteFile(filepath.Join(dir, pending.ID+".json"), raw, 0644)
+
+	pushes := make(chan *HookContext, 1)
+	q, err := NewJobQueue(JobQueueConfig{
+		Path:         dir,
+		Repositories: "/srv/git",
+		Handler:      func(h *HookContext) error { pushes <- h; return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	job := waitForJob(t, q, pending.ID, JobSucceeded)
+	if job.Attempts != 2 {
+		t.Errorf("expected the interrupted job to run again - actual %d attempts", job.Attempts)
+	}
+
+	if h := <-pushes; h.Repository != "adam/test.git" || h.FullRepoPath != "/srv/git/adam/test.git" || h.Principal == nil || h.Principal.Name != "adam" {
+		t.Errorf("expected the job to find adam/test.git pushed by adam - actual %+v", h)
+	}
+}
+
+func Test_JobQueue_synchronous(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gittp")
+	defer os.RemoveAll(dir)
+
+	q, err := NewJobQueue(JobQueueConfig{
+		Path:         dir,
+		Repositories: dir,
+		Synchronous:  true,
+		Handler:      func(h *HookContext) error { return h.Writeln("building") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	progress := &bytes.Buffer{}
+	job, err := q.Enqueue(&HookContext{
+		Repository:   "adam/test.git",
+		FullRepoPath: filepath.Join(dir, "adam/test.git"),
+		Principal:    &Principal{Name: "adam", Claims: map[string]interface{}{"email": "adam@example.com"}, Scope: AccessPolicy{{"adam", WriteAccess, "*"}}},
+		RefUpdates:   []RefUpdate{{Old: zeroHash, New: zeroHash, Ref: "refs/heads/master", Type: CreateUpdate}},
+		w:            progress,
+		capabilities: []string{"side-band-64k"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.State != JobSucceeded {
+		t.Errorf("expected the job to finish before Enqueue returns - actual %s", job.State)
+	}
+
+	if !strings.Contains(progress.String(), "building") {
+		t.Errorf("expected progress to be written to the client - actual %q", progress.String())
+	}
+
+	res := httptest.NewRecorder()
+	q.ServeHTTP(res, createRequest("GET", "/"+job.ID))
+
+	body := res.Body.String()
+	status := Job{}
+	if err := json.Unmarshal([]byte(body), &status); err != nil || status.ID != job.ID || status.State != JobSucceeded || status.Pusher != "adam" {
+		t.Errorf("expected the status API to return the job - actual %v %v", status, err)
+	}
+
+	// the status API is not authenticated, so nothing beyond who pushed what should show up in it
+	for _, secret := range []string{"adam@example.com", dir, "Claims", "Scope"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("expected %q not to be served - actual %s", secret, body)
+		}
+	}
+
+	if !strings.Contains(body, `"ref_updates":[{"old":"`) || !strings.Contains(body, `"ref":"refs/heads/master","type":"create"}`) {
+		t.Errorf("expected ref updates to be served with lower case keys - actual %s", body)
+	}
+
+	res = httptest.NewRecorder()
+	q.ServeHTTP(res, createRequest("GET", "/missing"))
+	if res.Code != 404 {
+		t.Errorf("expected 404 - actual %d", res.Code)
+	}
+}
+
+func Test_JobQueue_retention(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "gittp")
+	defer os.RemoveAll(dir)
+
+	old := time.Now().UTC().Add(-2 * time.Hour)
+	recent := time.Now().UTC()
+	stored := []Job{
+		{ID: "1-aaaa", Repository: "adam/test.git", State: JobSucceeded, UpdatedAt: old},
+		{ID: "2-bbbb", Repository: "adam/test.git", State: JobFailed, UpdatedAt: old},
+		{ID: "3-cccc", Repository: "adam/test.git", State: JobSucceeded, UpdatedAt: recent},
+	}
+
+	for _, job := range stored {
+		raw, _ := json.Marshal(job)
+		ioutil.WriteFile(filepath.Join(dir, job.ID+".json"), raw, 0644)
+	}
+
+	q, err := NewJobQueue(JobQueueConfig{
+		Path:         dir,
+		Repositories: dir,
+		Retention:    time.Hour,
+		Synchronous:  true,
+		Handler:      func(h *HookContext) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if jobs := q.Jobs(); len(jobs) != 1 || jobs[0].ID != "3-cccc" {
+		t.Errorf("expected only the recently finished job to be kept - actual %v", jobs)
+	}
+
+	for _, id := range []string{"1-aaaa", "2-bbbb"} {
+		if _, err := os.Stat(filepath.Join(dir, id+".json")); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be deleted from disk", id)
+		}
+	}
+
+	// jobs that are still to run are kept however old they are
+	q.mu.Lock()
+	q.jobs["3-cccc"].UpdatedAt = old
+	q.jobs["4-dddd"] = &Job{ID: "4-dddd", State: JobPending, UpdatedAt: old}
+	q.mu.Unlock()
+
+	job, err := q.Enqueue(&HookContext{Repository: "adam/test.git", w: ioutil.Discard})
+	if err != nil || job.State != JobSucceeded {
+		t.Fatalf("expected the job to succeed - actual %v %v", job.State, err)
+	}
+
+	kept := map[string]bool{}
+	for _, job := range q.Jobs() {
+		kept[job.ID] = true
+	}
+
+	if len(kept) != 2 || !kept["4-dddd"] || !kept[job.ID] {
+		t.Errorf("expected finishing a job to prune the old ones - actual %v", kept)
+	}
+}
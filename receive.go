@@ -0,0 +1,306 @@
+package gittp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+)
+
+var (
+	errHookTimeout   = errors.New("hook timed out")
+	errHookCancelled = errors.New("hook was cancelled")
+)
+
+// receivePack receives the pack of a push into a quarantine, runs the hooks against it and, if any refs are accepted, moves the objects into the repository and updates the accepted refs
+func (g *gitHTTPServer) receivePack(ctx handlerContext) error {
+	hookCtx := newHookContext(ctx)
+
+	if ctx.PushCert != "" {
+		hookCtx.PushCertificate = g.verifyPushCert(ctx)
+	}
+
+	config := readReceiveConfig(ctx.Context, ctx.FullRepoPath)
+
+	var q *quarantine
+	if sendsPack(ctx.Updates) {
+		var err error
+		if q, err = newQuarantine(ctx.Context, ctx.FullRepoPath, ctx.Body, config); err != nil {
+			if g.Debug {
+				log.Println("could not unpack", err)
+			}
+
+			if ctx.Context.Err() == context.DeadlineExceeded {
+				timedOut(ctx, ctx.Capabilities)
+				return err
+			}
+
+			return g.rejectPush(ctx, err, rejectAll(ctx.Updates, "unpacker error"))
+		}
+		defer q.Close()
+
+		if !q.connected(ctx.Context, ctx.FullRepoPath, ctx.Updates) {
+			return g.rejectPush(ctx, nil, rejectAll(ctx.Updates, "missing necessary objects"))
+		}
+
+		hookCtx.objectEnv = q.env(ctx.FullRepoPath)
+	}
+
+	// hookCtx shares its ref updates with ctx
+	for i, update := range ctx.Updates {
+		ctx.Updates[i].Type = updateType(ctx.Context, ctx.FullRepoPath, hookCtx.objectEnv, update)
+	}
+
+	if err := g.runHook(hookCtx, "pre-receive", g.PreReceive); err != nil {
+		return g.rejectPush(ctx, nil, rejectAll(ctx.Updates, err.Error()))
+	}
+
+	if g.RepositoryHooks {
+		lines := refUpdateLines(ctx.Updates)
+		if err := g.runHook(hookCtx, "pre-receive", func(h *HookContext) error { return repositoryHook(h, "pre-receive", lines) }); err != nil {
+			return g.rejectPush(ctx, nil, rejectAll(ctx.Updates, "pre-receive hook declined"))
+		}
+	}
+
+	statuses := g.runUpdateHooks(hookCtx, config)
+	if len(acceptedUpdates(ctx.Updates, statuses)) == 0 {
+		return g.rejectPush(ctx, nil, statuses)
+	}
+
+	atomic := hasCapability(ctx.Capabilities, "atomic")
+	if atomic && len(acceptedUpdates(ctx.Updates, statuses)) < len(ctx.Updates) {
+		return g.rejectPush(ctx, nil, failAtomic(statuses, "atomic push failure"))
+	}
+
+	// like git, every incoming object is kept once any ref is accepted, even those only reachable from rejected refs
+	if q != nil {
+		if err := q.migrate(ctx.FullRepoPath); err != nil {
+			if g.Debug {
+				log.Println("could not migrate quarantined objects", err)
+			}
+
+			return writeReportStatus(ctx.Output, ctx.Capabilities, nil, rejectAll(ctx.Updates, "unable to migrate objects to permanent storage"))
+		}
+
+		hookCtx.objectEnv = nil
+	}
+
+	if atomic {
+		if err := updateRefs(ctx.Context, ctx.FullRepoPath, ctx.Updates); err != nil {
+			if g.Debug {
+				log.Println("could not update refs atomically", err)
+			}
+
+			statuses = rejectAll(ctx.Updates, err.Error())
+		}
+	} else {
+		for i, update := range ctx.Updates {
+			if statuses[i].Reason != "" {
+				continue
+			}
+
+			if err := updateRef(ctx.Context, ctx.FullRepoPath, update); err != nil {
+				if g.Debug {
+					log.Println("could not update", update.Ref, err)
+				}
+
+				statuses[i].Reason = err.Error()
+			}
+		}
+	}
+
+	if g.DumbHTTP {
+		if err := updateServerInfo(ctx.Context, ctx.FullRepoPath); err != nil && g.Debug {
+			log.Println("could not update server info", err)
+		}
+	}
+
+	// like git, the client hears how its push went before the post receive hooks run, their output following the report over the side-band
+	if err := sendReportStatus(ctx.Output, ctx.Capabilities, nil, statuses); err != nil {
+		return err
+	}
+
+	if updates := acceptedUpdates(ctx.Updates, statuses); len(updates) > 0 {
+		hookCtx.RefUpdates = updates
+		hookCtx.Branch, hookCtx.Commit = updates[0].Ref, updates[0].New
+
+		g.runPostReceiveHooks(hookCtx)
+
+		// every push leaves a pack behind, so like receive-pack the repository is repacked once enough of them pile up
+		if config.autoGC {
+			if err := gcAuto(ctx.Context, ctx.FullRepoPath); err != nil && g.Debug {
+				log.Println("could not run git gc --auto", err)
+			}
+		}
+	}
+
+	return endSideband(ctx.Output, ctx.Capabilities)
+}
+
+func (g *gitHTTPServer) runPostReceiveHooks(hookCtx *HookContext) {
+	if g.PostReceive != nil {
+		g.runHook(hookCtx, "post-receive", func(h *HookContext) error {
+			archive, _ := gitArchive(h.Context(), h.FullRepoPath, h.Commit)
+			g.PostReceive(h, archive)
+			return nil
+		})
+	}
+
+	if g.PostReceiveStream != nil {
+		g.runHook(hookCtx, "post-receive", func(h *HookContext) error {
+			g.PostReceiveStream(h)
+			return nil
+		})
+	}
+
+	if g.Webhooks != nil {
+		go g.Webhooks.push(hookCtx)
+	}
+
+	// a synchronous queue runs the job right away, so it is held to the same timeout as any other hook
+	if g.PostReceiveQueue != nil {
+		g.runHook(hookCtx, "post-receive", func(h *HookContext) error {
+			job, err := g.PostReceiveQueue.Enqueue(h)
+			if err != nil {
+				log.Println("could not queue post receive job", err)
+			} else if g.Debug {
+				log.Println("queued post receive job", job.ID)
+			}
+
+			return err
+		})
+	}
+
+	if g.RepositoryHooks {
+		lines := refUpdateLines(hookCtx.RefUpdates)
+		if err := g.runHook(hookCtx, "post-receive", func(h *HookContext) error { return repositoryHook(h, "post-receive", lines) }); err != nil && g.Debug {
+			log.Println("post-receive hook failed", err)
+		}
+
+		refs := []string{}
+		for _, update := range hookCtx.RefUpdates {
+			refs = append(refs, update.Ref)
+		}
+
+		if err := g.runHook(hookCtx, "post-update", func(h *HookContext) error { return repositoryHook(h, "post-update", nil, refs...) }); err != nil && g.Debug {
+			log.Println("post-update hook failed", err)
+		}
+	}
+}
+
+// runUpdateHooks asks the update hook about every ref in the push that the repository's receive.denyDeletes and receive.denyNonFastForwards allow
+func (g *gitHTTPServer) runUpdateHooks(hookCtx *HookContext, config receiveConfig) []refStatus {
+	statuses := make([]refStatus, len(hookCtx.RefUpdates))
+
+	for i, update := range hookCtx.RefUpdates {
+		statuses[i].Ref = update.Ref
+
+		if reason := config.deny(update); reason != "" {
+			statuses[i].Reason = reason
+			continue
+		}
+
+		if g.Update != nil {
+			if err := g.runHook(hookCtx, "update", func(h *HookContext) error { return g.Update(h, update) }); err != nil {
+				if g.Debug {
+					log.Println("ref update declined by update hook", update.Ref, err)
+				}
+
+				statuses[i].Reason = err.Error()
+				continue
+			}
+		}
+
+		if g.RepositoryHooks {
+			if err := g.runHook(hookCtx, "update", func(h *HookContext) error {
+				return repositoryHook(h, "update", nil, update.Ref, update.Old, update.New)
+			}); err != nil {
+				statuses[i].Reason = "hook declined"
+			}
+		}
+	}
+
+	return statuses
+}
+
+// runHook runs hook with a context that is cancelled once HookTimeout passes or the request is done, giving up on the hook and telling the client why when that happens first
+func (g *gitHTTPServer) runHook(h *HookContext, name string, hook func(*HookContext) error) error {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if g.HookTimeout > 0 {
+		ctx, cancel = context.WithTimeout(h.Context(), g.HookTimeout)
+	} else {
+		ctx, cancel = context.WithCancel(h.Context())
+	}
+	defer cancel()
+
+	// the hook gets a copy, so one that keeps running after it is given up on can't see later changes to the push, and can't write to the client anymore either
+	w := &hookWriter{w: h.w}
+	defer w.close()
+
+	hookCtx := *h
+	hookCtx.ctx = ctx
+	hookCtx.w = w
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- fmt.Errorf("%s hook panicked: %v", name, r)
+			}
+		}()
+
+		done <- hook(&hookCtx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	err := errHookCancelled
+	if ctx.Err() == context.DeadlineExceeded {
+		err = errHookTimeout
+	}
+
+	w.close()
+
+	// by the time post receive hooks run the refs are updated, so there is no failing the push anymore
+	if name == "post-receive" || name == "post-update" {
+		log.Println(name, err, "for", h.Repository)
+		h.Writelnf("warning: %s %s", name, err)
+		return err
+	}
+
+	if g.Debug {
+		log.Println(name, err)
+	}
+
+	h.Fatal(fmt.Sprintf("%s %s", name, err))
+	return err
+}
+
+// rejectPush declines the push, reporting the reason for each ref back to the client
+func (g *gitHTTPServer) rejectPush(ctx handlerContext, unpackErr error, statuses []refStatus) error {
+	if g.Debug {
+		log.Println("push declined by hooks")
+	}
+
+	// the client expects the whole request to be consumed before it reads a response
+	io.Copy(io.Discard, ctx.Input)
+
+	return writeReportStatus(ctx.Output, ctx.Capabilities, unpackErr, statuses)
+}
+
+func acceptedUpdates(updates []RefUpdate, statuses []refStatus) []RefUpdate {
+	accepted := []RefUpdate{}
+	for i, update := range updates {
+		if statuses[i].Reason == "" {
+			accepted = append(accepted, update)
+		}
+	}
+
+	return accepted
+}
@@ -0,0 +1,170 @@
+package gittp
+
+import (
+	"bytes"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_gitHTTPServer_runHook(t *testing.T) {
+	g := &gitHTTPServer{ServerConfig{HookTimeout: 50 * time.Millisecond}}
+
+	cases := []struct {
+		name     string
+		hook     func(*HookContext) error
+		expected error
+		written  string
+	}{
+		{"update", func(h *HookContext) error { return nil }, nil, ""},
+		{"update", func(h *HookContext) error { return errors.New("declined") }, errors.New("declined"), ""},
+		{"update", func(h *HookContext) error { <-h.Context().Done(); return nil }, errHookTimeout, "\x03error: update hook timed out\n"},
+		{"update", func(h *HookContext) error { panic("boom") }, errors.New("update hook panicked: boom"), ""},
+		// the refs are already updated when post receive hooks run, so a timeout there is only a warning
+		{"post-receive", func(h *HookContext) error { <-h.Context().Done(); return nil }, errHookTimeout, "\x02warning: post-receive hook timed out\n"},
+	}
+
+	for i, c := range cases {
+		output := &bytes.Buffer{}
+		h := &HookContext{w: output, capabilities: []string{"side-band-64k"}}
+
+		err := g.runHook(h, c.name, c.hook)
+		if (err == nil) != (c.expected == nil) || (err != nil && err.Error() != c.expected.Error()) {
+			t.Errorf("%d: expected %v but got %v", i, c.expected, err)
+		}
+
+		if c.written == "" && output.Len() > 0 || !strings.HasSuffix(output.String(), c.written) {
+			t.Errorf("%d: expected %q to be written to the client but got %q", i, c.written, output.String())
+		}
+	}
+}
+
+func Test_gitHTTPServer_runHook_writesAfterTimeout(t *testing.T) {
+	g := &gitHTTPServer{ServerConfig{HookTimeout: 20 * time.Millisecond}}
+
+	output := &bytes.Buffer{}
+	h := &HookContext{w: output, capabilities: []string{"side-band-64k"}}
+
+	stopped := make(chan struct{})
+	defer func() { <-stopped }()
+
+	// the hook ignores its context and keeps writing long after it is given up on
+	err := g.runHook(h, "pre-receive", func(h *HookContext) error {
+		defer close(stopped)
+		for end := time.Now().Add(100 * time.Millisecond); time.Now().Before(end); {
+			h.Writeln("still going")
+		}
+		return nil
+	})
+	if err != errHookTimeout {
+		t.Fatalf("expected the hook to time out but got %v", err)
+	}
+
+	written := output.String()
+	if !strings.HasSuffix(written, "\x03error: pre-receive hook timed out\n") {
+		t.Errorf("expected the timeout to be the last thing written but got %q", written[len(written)-50:])
+	}
+
+	<-stopped
+	if output.String() != written {
+		t.Error("expected writes made after the hook timed out to be dropped")
+	}
+}
+
+func Test_gitHTTPServer_push(t *testing.T) {
+	repo, base := createTestRepo(t)
+	dir := filepath.Dir(repo)
+	defer os.RemoveAll(dir)
+
+	handler, err := NewGitServer(ServerConfig{
+		Path: dir,
+		PreReceive: func(h *HookContext) error {
+			for _, update := range h.RefUpdates {
+				if update.Ref == "refs/heads/declined" {
+					return errors.New("declined")
+				}
+			}
+			return nil
+		},
+		Update: func(h *HookContext, update RefUpdate) error {
+			if update.Ref == "refs/heads/rejected" {
+				return errors.New("not allowed")
+			}
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	work := filepath.Join(dir, "work")
+	remote := server.URL + "/repo.git"
+
+	push := func(args ...string) (string, error) {
+		cmd := exec.Command("git", append([]string{"push", "--porcelain", remote}, args...)...)
+		cmd.Dir = work
+		output, err := cmd.CombinedOutput()
+		return string(output), err
+	}
+
+	refExists := func(ref string) bool {
+		return exec.Command("git", "-C", repo, "rev-parse", "--verify", "-q", ref).Run() == nil
+	}
+
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "accepted")
+	accepted := runGit(t, work, "rev-parse", "HEAD")
+
+	if output, err := push("HEAD:refs/heads/master"); err != nil {
+		t.Fatalf("expected the push to be accepted: %v\n%s", err, output)
+	}
+
+	if actual := runGit(t, repo, "rev-parse", "refs/heads/master"); actual != accepted {
+		t.Errorf("expected master to be updated to %s - actual %s", accepted, actual)
+	}
+
+	// the update hook rejects one ref while the other goes through
+	output, err := push("HEAD:refs/heads/ok", "HEAD:refs/heads/rejected")
+	if err == nil || !strings.Contains(output, "refs/heads/rejected\t[remote rejected] (not allowed)") {
+		t.Errorf("expected refs/heads/rejected to be rejected: %v\n%s", err, output)
+	}
+
+	if !refExists("refs/heads/ok") || refExists("refs/heads/rejected") {
+		t.Error("expected only refs/heads/ok to be created")
+	}
+
+	// an atomic push fails as a whole
+	output, err = push("--atomic", "HEAD:refs/heads/atomic", "HEAD:refs/heads/rejected")
+	if err == nil || !strings.Contains(output, "refs/heads/atomic\t[remote rejected] (atomic push failure)") {
+		t.Errorf("expected the atomic push to fail: %v\n%s", err, output)
+	}
+
+	if refExists("refs/heads/atomic") {
+		t.Error("expected refs/heads/atomic not to be created")
+	}
+
+	// the objects of a push that is declined are thrown away with its quarantine
+	runGit(t, work, "reset", "-q", "--hard", base)
+	runGit(t, work, "commit", "-q", "--allow-empty", "-m", "declined")
+	declined := runGit(t, work, "rev-parse", "HEAD")
+
+	output, err = push("HEAD:refs/heads/declined")
+	if err == nil || !strings.Contains(output, "refs/heads/declined\t[remote rejected] (declined)") {
+		t.Errorf("expected the push to be declined: %v\n%s", err, output)
+	}
+
+	if exec.Command("git", "-C", repo, "cat-file", "-e", declined).Run() == nil {
+		t.Error("expected the objects of the declined push to be thrown away")
+	}
+
+	if incoming, _ := filepath.Glob(filepath.Join(repo, "objects", "incoming-*")); len(incoming) > 0 {
+		t.Errorf("expected the quarantine to be removed - actual %v", incoming)
+	}
+}
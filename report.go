@@ -0,0 +1,100 @@
+package gittp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// refStatus is the outcome of a single ref update, reported back to git clients that asked for report-status
+type refStatus struct {
+	Ref string
+	// Reason is the message shown next to a rejected ref. It is empty when the update succeeded
+	Reason string
+}
+
+func hasCapability(capabilities []string, capability string) bool {
+	for _, c := range capabilities {
+		if c == capability {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rejectAll returns a failing status for every ref update in a push
+func rejectAll(updates []RefUpdate, reason string) []refStatus {
+	statuses := make([]refStatus, len(updates))
+	for i, update := range updates {
+		statuses[i] = refStatus{update.Ref, reason}
+	}
+
+	return statuses
+}
+
+// failAtomic rejects every ref that has not been rejected already with reason, since one failed ref fails an atomic push as a whole
+func failAtomic(statuses []refStatus, reason string) []refStatus {
+	failed := make([]refStatus, len(statuses))
+	for i, status := range statuses {
+		failed[i] = status
+		if status.Reason == "" {
+			failed[i].Reason = reason
+		}
+	}
+
+	return failed
+}
+
+// encodeReportStatus builds the report-status (and report-status-v2) response for a push. unpackErr is why the pack could not be unpacked, if it could not.
+func encodeReportStatus(unpackErr error, statuses []refStatus) []byte {
+	report := &bytes.Buffer{}
+	if unpackErr != nil {
+		report.Write(pktline(fmt.Sprintf("unpack %s\n", unpackErr)))
+	} else {
+		report.Write(pktline("unpack ok\n"))
+	}
+
+	for _, status := range statuses {
+		if status.Reason == "" {
+			report.Write(pktline(fmt.Sprintf("ok %s\n", status.Ref)))
+		} else {
+			reason := strings.Replace(strings.TrimSpace(status.Reason), "\n", " ", -1)
+			report.Write(pktline(fmt.Sprintf("ng %s %s\n", status.Ref, reason)))
+		}
+	}
+
+	report.Write(pktline(""))
+	return report.Bytes()
+}
+
+// writeReportStatus sends the result of each ref update to the client and ends the response
+func writeReportStatus(w io.Writer, capabilities []string, unpackErr error, statuses []refStatus) error {
+	if err := sendReportStatus(w, capabilities, unpackErr, statuses); err != nil {
+		return err
+	}
+
+	return endSideband(w, capabilities)
+}
+
+// sendReportStatus sends the result of each ref update to the client, leaving the side-band open for progress that follows it. The report goes over the pack data band when a side-band was negotiated, and is left out if the client did not ask for report-status.
+func sendReportStatus(w io.Writer, capabilities []string, unpackErr error, statuses []refStatus) error {
+	report := []byte{}
+	if hasCapability(capabilities, "report-status") || hasCapability(capabilities, "report-status-v2") {
+		report = encodeReportStatus(unpackErr, statuses)
+	}
+
+	_, err := newSidebandWriter(w, capabilities, packDataStreamCode).Write(report)
+	return err
+}
+
+// endSideband ends a side-band response with a flush-pkt, and does nothing when no side-band was negotiated
+func endSideband(w io.Writer, capabilities []string) error {
+	if sidebandPayload(capabilities) == 0 {
+		return nil
+	}
+
+	_, err := w.Write(pktline(""))
+	return err
+}
@@ -0,0 +1,77 @@
+package gittp
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func Test_encodeReportStatus(t *testing.T) {
+	statuses := []refStatus{
+		{"refs/heads/master", ""},
+		{"refs/heads/feature", "not allowed\n"},
+	}
+
+	expected := "000eunpack ok\n" +
+		"0019ok refs/heads/master\n" +
+		"0026ng refs/heads/feature not allowed\n" +
+		"0000"
+
+	actual := encodeReportStatus(nil, statuses)
+	if string(actual) != expected {
+		t.Errorf("expected:\n%q\nactual:\n%q\n", expected, actual)
+	}
+
+	expected = "0024unpack index-pack abnormal exit\n" +
+		"0028ng refs/heads/master unpacker error\n" +
+		"0000"
+
+	actual = encodeReportStatus(errors.New("index-pack abnormal exit"), rejectAll([]RefUpdate{{Ref: "refs/heads/master"}}, "unpacker error"))
+	if string(actual) != expected {
+		t.Errorf("expected:\n%q\nactual:\n%q\n", expected, actual)
+	}
+}
+
+func Test_failAtomic(t *testing.T) {
+	statuses := []refStatus{
+		{"refs/heads/master", ""},
+		{"refs/heads/feature", "not allowed"},
+	}
+
+	actual := failAtomic(statuses, "atomic push failure")
+	if actual[0].Reason != "atomic push failure" || actual[1].Reason != "not allowed" {
+		t.Errorf("expected accepted refs to fail with the atomic push and rejected refs to keep their reasons, actual %v", actual)
+	}
+
+	if statuses[0].Reason != "" {
+		t.Error("expected the statuses to be left alone")
+	}
+}
+
+func Test_writeReportStatus(t *testing.T) {
+	statuses := []refStatus{{"refs/heads/master", "declined"}}
+	report := string(encodeReportStatus(nil, statuses))
+
+	cases := []struct {
+		capabilities []string
+		expected     string
+	}{
+		{[]string{}, ""},
+		{[]string{"side-band-64k"}, "0000"},
+		{[]string{"report-status"}, report},
+		{[]string{"report-status-v2"}, report},
+		{[]string{"report-status", "side-band-64k"}, string(encodeWithPrefix(packDataStreamCode, report)) + "0000"},
+		{[]string{"report-status", "side-band"}, string(encodeWithPrefix(packDataStreamCode, report)) + "0000"},
+	}
+
+	for _, c := range cases {
+		actual := &bytes.Buffer{}
+		if err := writeReportStatus(actual, c.capabilities, nil, statuses); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.String() != c.expected {
+			t.Errorf("%v\nexpected:\n%q\nactual:\n%q\n", c.capabilities, c.expected, actual.String())
+		}
+	}
+}
@@ -1,22 +1,31 @@
 package gittp
 
 import (
-	"bytes"
+	"context"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 )
 
-// PreReceiveHook is a func called on pre receive. This is right before a git push is processed. Returning false from this handler will cancel the push to the remote, and returning true will allow the process to continue
+// PreReceiveHook is a func called on pre receive. This is right before a git push is processed. Returning an error from this handler will cancel the push to the remote and the error message is reported to the client as the reason each ref was rejected, returning nil will allow the process to continue
 type PreReceiveHook func(*HookContext) error
 
 // PostReceiveHook is a func called after git-receive-pack is ran. This is a good place to fire notifications.
 type PostReceiveHook func(*HookContext, []byte)
 
+// PostReceiveStreamHook is a func called after git-receive-pack is ran, like PostReceiveHook, except that no archive is read into memory ahead of time. Call HookContext.Archive to stream a snapshot of the pushed commit in the format you need.
+type PostReceiveStreamHook func(*HookContext)
+
+// UpdateHook is a func called once for every ref update in a push after the PreReceiveHook succeeds, mirroring git's update hook. Returning an error rejects only that ref, with the error message reported to the client as the reason, while the rest of the push goes through
+type UpdateHook func(*HookContext, RefUpdate) error
+
+// PreUploadHook is a func called before a client is sent refs or a pack from a repository, on both the ref advertisement and the pack request of a fetch or clone, and for every file a dumb HTTP client asks for. Returning an error denies the fetch, with the error message reported to the client.
+type PreUploadHook func(*UploadContext) error
+
 // PreCreateHook is a func called before a missing repository is created. Returning false from this handler will prevent a new repository from being created.
 type PreCreateHook func(string) bool
 
@@ -28,12 +37,54 @@ type ServerConfig struct {
 	// Enables debug logging
 	Debug bool
 
+	// Authenticator checks the credentials of every request. Requests without valid credentials are turned away with a 401 Unauthorized. When nil, no authentication is done.
+	Authenticator Authenticator
+
+	// Authorizer decides which repositories each principal can read from and push to. When an Authorizer is set, requests without credentials are allowed through to it as anonymous.
+	Authorizer Authorizer
+
+	// DumbHTTP enables read only support for the dumb HTTP protocol, for very old clients and simple tools that fetch repository files directly
+	DumbHTTP bool
+
 	// PostReceive is a post receive hook that is ran after refs have been successfully processed. Useful for running automated builds, sending notifications etc.
 	PostReceive PostReceiveHook
 
+	// PostReceiveStream is ran after refs have been successfully processed, like PostReceive, but leaves it up to the hook to stream an archive if it needs one. Prefer this over PostReceive for large repositories.
+	PostReceiveStream PostReceiveStreamHook
+
+	// PostReceiveQueue, when set, gets a job for every push that had refs accepted. The job runs in the background so that a slow hook doesn't hold up the client's git push, and failed jobs are retried.
+	PostReceiveQueue *JobQueue
+
+	// Webhooks are sent a payload for every push that had refs accepted
+	Webhooks *Webhooks
+
+	// HookTimeout limits how long each hook may run. A hook that runs over has its HookContext.Context cancelled and the client is told it timed out, and pre receive and update hooks that time out reject the push. Zero means hooks may run for as long as the request does.
+	HookTimeout time.Duration
+
+	// RequestTimeout limits how long a request, including the git processes and hooks it runs, may take. Zero means no limit.
+	RequestTimeout time.Duration
+
+	// PushCertNonceSeed enables signed pushes, git push --signed, when set. It is the secret the nonces clients sign are made from, like git's receive.certNonceSeed. The push certificate is available to hooks as HookContext.PushCertificate.
+	PushCertNonceSeed string
+
+	// PushCertNonceSlop is how long ago a push certificate's nonce may have been handed out for its NonceStatus to be NonceOK instead of NonceSlop. A signed push over HTTP takes separate requests for the nonce and the push, so this should be at least a few seconds.
+	PushCertNonceSlop time.Duration
+
+	// Keyring holds the keys push certificate signatures are verified against
+	Keyring *Keyring
+
+	// RepositoryHooks runs the pre-receive, update, post-receive and post-update scripts found in each repository's hooks directory, after the matching Go hooks, the same way git does. Their stdin, arguments and exit codes follow git's conventions, and anything they print is streamed to the client. Pushes are not received by git receive-pack, so these scripts don't run at all when RepositoryHooks is off.
+	RepositoryHooks bool
+
 	// PreReceive is a pre receive hook that is ran before the repo is updated. Useful for enforcing branch naming (master only pushing).
 	PreReceive PreReceiveHook
 
+	// Update is a hook that is ran for each ref being pushed after PreReceive succeeds. Useful for accepting some refs in a push while rejecting others.
+	Update UpdateHook
+
+	// PreUpload is a hook that is ran before every fetch and clone. Useful for auditing reads and denying access to repositories.
+	PreUpload PreUploadHook
+
 	// PreCreate is a hook called when a push causes a new repository to be created. This hook is ran before the repo is created.
 	PreCreate PreCreateHook
 }
@@ -76,31 +127,64 @@ func (g *gitHTTPServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 	header.Set("Server", "gittp")
 	header.Set("X-Frame-Options", "DENY")
 
-	ctx, err := newHandlerContext(res, req, g.Path)
+	if g.RequestTimeout > 0 {
+		timeout, cancel := context.WithTimeout(req.Context(), g.RequestTimeout)
+		defer cancel()
+
+		req = req.WithContext(timeout)
+	}
+
+	principal, ok := g.authenticate(res, req)
+	if !ok {
+		return
+	}
+
+	if g.DumbHTTP && (req.Method == "GET" || req.Method == "HEAD") {
+		if repoName, file, ok := parseDumbRequest(req.URL); ok {
+			if g.authorize(res, principal, repoName, ReadAccess) && (g.PreUpload == nil || g.preUploadDumb(res, req, principal, repoName, file)) {
+				g.serveDumb(res, req, repoName, file)
+			}
+			return
+		}
+	}
+
+	ctx, err := newHandlerContext(res, req, g.Path, principal)
 
 	if err != nil {
 		if g.Debug {
 			log.Println("could not create handler context", err)
 		}
 
-		res.WriteHeader(http.StatusInternalServerError)
+		if err == errUnsupportedEncoding {
+			res.WriteHeader(http.StatusUnsupportedMediaType)
+		} else if err == errInvalidRepoName {
+			res.WriteHeader(http.StatusBadRequest)
+		} else {
+			res.WriteHeader(http.StatusInternalServerError)
+		}
 		return
 	}
 
-	header.Set("Content-Type", contentType(ctx.ServiceType, ctx.Advertisement))
+	op := ReadAccess
+	if ctx.IsReceivePack {
+		op = WriteAccess
+	}
 
-	if ctx.ShouldRunHooks {
-		ok, hookContinuation := g.runHooks(ctx)
-		if !ok {
-			return
-		}
+	if !g.authorize(res, principal, ctx.RepoName, op) {
+		return
+	}
+
+	header.Set("Content-Type", contentType(ctx.ServiceType, ctx.Advertisement))
 
-		ctx.Output = &bytes.Buffer{}
-		defer func() {
-			io.Copy(res, ctx.Output.(io.Reader))
-		}()
+	// a fetch the hook denies must not create the repository it names either
+	if !ctx.IsReceivePack && g.PreUpload != nil && !g.preUpload(ctx) {
+		return
+	}
 
-		defer hookContinuation()
+	// reading from a repository is no reason to create it, so a missing one is only created for those who could push to it
+	if !ctx.RepoExists && op != WriteAccess && !g.allowed(principal, ctx.RepoName, WriteAccess) {
+		res.WriteHeader(http.StatusNotFound)
+		return
 	}
 
 	if err := g.createRepoIfMissing(ctx); err != nil {
@@ -108,45 +192,126 @@ func (g *gitHTTPServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if ctx.IsGetRefs {
+	if ctx.ShouldRunHooks {
+		if err := g.receivePack(ctx); err != nil && g.Debug {
+			log.Println("an error occurred receiving push", err)
+		}
+
+		return
+	}
+
+	if g.Debug && ctx.Command != "" {
+		log.Println("protocol v2 command", ctx.Command)
+	}
+
+	// protocol v2 capability advertisements go out without the service header
+	if ctx.IsGetRefs && ctx.ProtocolVersion < 2 {
 		svc := pktline(fmt.Sprintf("# service=%s\n", ctx.ServiceType))
 
 		ctx.Output.Write(svc)
 		ctx.Output.Write(pktline(""))
 	}
 
-	err = runCmd(ctx.ServiceType, ctx.FullRepoPath, ctx.Input, ctx.Output, ctx.Advertisement)
+	env := []string{}
+	if ctx.IsReceivePack {
+		config := []string{"receive.advertisePushOptions", "true"}
+		if g.PushCertNonceSeed != "" {
+			config = append(config, "receive.certNonceSeed", g.PushCertNonceSeed)
+		}
+
+		env = gitConfigEnv(config...)
+	}
+
+	err = runCmd(ctx.Context, ctx.ServiceType, ctx.FullRepoPath, ctx.Input, ctx.Output, ctx.Advertisement, ctx.GitProtocol, env...)
 	if err != nil {
 		if g.Debug {
 			log.Println("an error occurred running", ctx.ServiceType, err)
 		}
+
+		if ctx.Context.Err() == context.DeadlineExceeded {
+			capabilities := ctx.Upload.Capabilities
+			if ctx.IsReceivePack {
+				capabilities = ctx.Capabilities
+			}
+
+			timedOut(ctx, capabilities)
+		}
 	}
 }
 
-func (g *gitHTTPServer) runHooks(ctx handlerContext) (bool, func()) {
-	hookCtx := newHookContext(ctx)
+// timedOut logs a request that ran out of time and, if the client negotiated a side-band, tells it why the response stopped short instead of leaving it to guess at a cut off stream
+func timedOut(ctx handlerContext, capabilities []string) {
+	log.Println(ctx.ServiceType, "timed out for", ctx.RepoName)
+	newSidebandWriter(ctx.Output, capabilities, fatalStreamCode).Write([]byte(fmt.Sprintf("error: %s timed out\n", ctx.ServiceType)))
+}
+
+// authenticate checks the request's credentials when an Authenticator is configured, answering with a 401 if they are invalid. Requests without credentials are only let through when an Authorizer is around to decide what they can access.
+func (g *gitHTTPServer) authenticate(res http.ResponseWriter, req *http.Request) (*Principal, bool) {
+	if g.Authenticator == nil {
+		return nil, true
+	}
 
-	flush := func() {}
+	principal, err := g.Authenticator.Authenticate(req)
+	if err == nil && (principal != nil || g.Authorizer != nil) {
+		return principal, true
+	}
 
-	if err := g.PreReceive(hookCtx); err != nil {
-		// statusHeader := pktline("unpack ok\n")
-		// reportStatus := pktline(fmt.Sprintf("ng %s %v\n", hookCtx.Branch, err))
-		// payload := fmt.Sprintf("%s%s", statusHeader, reportStatus)
-		// status := writePacket(fmt.Sprintf("\x01%s0000", payload))
-		// ctx.Output.Write(status)
-		return false, flush
+	if err != nil && g.Debug {
+		log.Println("authentication failed", err)
 	}
 
-	if g.PostReceive != nil {
-		return true, func() {
-			defer flush()
-			// so we can get real time progress writes
-			archive, _ := gitArchive(ctx.FullRepoPath, hookCtx.Commit)
-			g.PostReceive(hookCtx, archive)
-		}
+	unauthorized(res)
+	return nil, false
+}
+
+// authorize checks that principal may perform op on the repository, both within the principal's own scope and according to the Authorizer, answering with a 401 for anonymous requests so git asks for credentials, or a 403 otherwise
+func (g *gitHTTPServer) authorize(res http.ResponseWriter, principal *Principal, repoName string, op Operation) bool {
+	if g.allowed(principal, repoName, op) {
+		return true
 	}
 
-	return true, flush
+	if g.Debug {
+		log.Println("access denied", op, repoName)
+	}
+
+	if principal == nil {
+		unauthorized(res)
+	} else {
+		res.WriteHeader(http.StatusForbidden)
+	}
+
+	return false
+}
+
+// preUpload asks the PreUpload hook whether a fetch may go ahead, answering the client with an ERR pkt-line when it may not
+func (g *gitHTTPServer) preUpload(ctx handlerContext) bool {
+	err := g.PreUpload(newUploadContext(ctx))
+	if err == nil {
+		return true
+	}
+
+	if g.Debug {
+		log.Println("fetch declined by pre upload hook", err)
+	}
+
+	if ctx.IsGetRefs && ctx.ProtocolVersion < 2 {
+		ctx.Output.Write(pktline(fmt.Sprintf("# service=%s\n", ctx.ServiceType)))
+		ctx.Output.Write(pktline(""))
+	}
+
+	ctx.Output.Write(pktline("ERR " + err.Error() + "\n"))
+	return false
+}
+
+// allowed reports whether principal may perform op on the repository, both within the principal's own scope and according to the Authorizer
+func (g *gitHTTPServer) allowed(principal *Principal, repoName string, op Operation) bool {
+	inScope := principal == nil || principal.Scope == nil || principal.Scope.Authorize(principal, repoName, op)
+	return inScope && (g.Authorizer == nil || g.Authorizer.Authorize(principal, repoName, op))
+}
+
+func unauthorized(res http.ResponseWriter) {
+	res.Header().Set("WWW-Authenticate", `Basic realm="gittp"`)
+	res.WriteHeader(http.StatusUnauthorized)
 }
 
 func (g *gitHTTPServer) createRepoIfMissing(ctx handlerContext) error {
@@ -0,0 +1,26 @@
+package gittp
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_timedOut(t *testing.T) {
+	cases := []struct {
+		capabilities []string
+		expected     string
+	}{
+		{[]string{}, ""},
+		{[]string{"side-band"}, "0026\x03error: git-upload-pack timed out\n"},
+		{[]string{"multi_ack", "side-band-64k"}, "0026\x03error: git-upload-pack timed out\n"},
+	}
+
+	for _, c := range cases {
+		res := httptest.NewRecorder()
+		timedOut(handlerContext{ServiceType: "git-upload-pack", RepoName: "repo.git", Output: res}, c.capabilities)
+
+		if res.Body.String() != c.expected {
+			t.Errorf("%v: expected %q - actual %q", c.capabilities, c.expected, res.Body.String())
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package gittp
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// the largest payload side-band and side-band-64k allow in a single packet, minus the band byte
+	maxSideBandPayload   = 995
+	maxSideBand64Payload = 65515
+	// the largest payload a single pkt-line can carry
+	maxPktPayload = 65516
+)
+
+// sidebandPayload is the largest payload that fits in a packet of the side-band the client negotiated, or 0 if it negotiated none
+func sidebandPayload(capabilities []string) int {
+	if hasCapability(capabilities, "side-band-64k") {
+		return maxSideBand64Payload
+	} else if hasCapability(capabilities, "side-band") {
+		return maxSideBandPayload
+	}
+
+	return 0
+}
+
+// sidebandWriter writes to one band of the side-band the client negotiated, splitting writes into as many packets as they need
+type sidebandWriter struct {
+	w          io.Writer
+	band       streamCode
+	maxPayload int
+}
+
+func newSidebandWriter(w io.Writer, capabilities []string, band streamCode) *sidebandWriter {
+	return &sidebandWriter{w: w, band: band, maxPayload: sidebandPayload(capabilities)}
+}
+
+// Write sends p over the band, flushing it to the client so it shows up as it is written. Without a side-band, pack data is written as is and progress and errors are dropped, since the client has nowhere to show them
+func (s *sidebandWriter) Write(p []byte) (int, error) {
+	defer flush(s.w)
+
+	if s.maxPayload == 0 {
+		if s.band == packDataStreamCode {
+			return s.w.Write(p)
+		}
+
+		return len(p), nil
+	}
+
+	for written := 0; written < len(p); {
+		chunk := p[written:]
+		if len(chunk) > s.maxPayload {
+			chunk = chunk[:s.maxPayload]
+		}
+
+		if _, err := s.w.Write(encodeWithPrefix(s.band, string(chunk))); err != nil {
+			return written, err
+		}
+
+		written += len(chunk)
+	}
+
+	return len(p), nil
+}
+
+// hookWriter is what a hook writes to the client through. runHook closes it once it is done with the hook, so a hook that is given up on but keeps running can't write over the rest of the response, or into a response writer that has been handed to another request.
+type hookWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+// Write passes p on to the client, or drops it once the writer is closed
+func (h *hookWriter) Write(p []byte) (int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return len(p), nil
+	}
+
+	return h.w.Write(p)
+}
+
+// Flush flushes the client's response writer, unless the writer is closed
+func (h *hookWriter) Flush() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.closed {
+		flush(h.w)
+	}
+}
+
+// close drops every write after it, waiting for one that is in progress to finish
+func (h *hookWriter) close() {
+	h.mu.Lock()
+	h.closed = true
+	h.mu.Unlock()
+}
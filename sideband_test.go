@@ -0,0 +1,103 @@
+package gittp
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_sidebandWriter(t *testing.T) {
+	message := strings.Repeat("x", 2*maxSideBand64Payload+10)
+
+	cases := []struct {
+		capabilities []string
+		band         streamCode
+		maxPayload   int
+	}{
+		{[]string{"report-status", "side-band-64k"}, progressStreamCode, maxSideBand64Payload},
+		{[]string{"report-status", "side-band"}, fatalStreamCode, maxSideBandPayload},
+		{[]string{"report-status"}, progressStreamCode, 0},
+		{[]string{"report-status"}, packDataStreamCode, 0},
+	}
+
+	for _, c := range cases {
+		output := &bytes.Buffer{}
+		if n, err := newSidebandWriter(output, c.capabilities, c.band).Write([]byte(message)); err != nil || n != len(message) {
+			t.Fatalf("%v: expected all %d bytes to be written but got %d %v", c.capabilities, len(message), n, err)
+		}
+
+		if c.maxPayload == 0 {
+			expected := ""
+			if c.band == packDataStreamCode {
+				expected = message
+			}
+
+			if output.String() != expected {
+				t.Errorf("%v %q: expected %d bytes to be written as is but got %d", c.capabilities, c.band, len(expected), output.Len())
+			}
+
+			continue
+		}
+
+		received := &bytes.Buffer{}
+		for {
+			_, payload, err := readPktLine(output)
+			if err != nil {
+				break
+			}
+
+			if streamCode(payload[:1]) != c.band || len(payload)-1 > c.maxPayload {
+				t.Fatalf("%v: expected packets of at most %d bytes on band %q but got %d on %q", c.capabilities, c.maxPayload, c.band, len(payload)-1, payload[:1])
+			}
+
+			// only the last packet may be short
+			if received.Len()+len(payload)-1 < len(message) && len(payload)-1 != c.maxPayload {
+				t.Errorf("%v: expected a full packet of %d bytes but got %d", c.capabilities, c.maxPayload, len(payload)-1)
+			}
+
+			received.Write(payload[1:])
+		}
+
+		if received.String() != message {
+			t.Errorf("%v: expected the message to be reassembled from its packets", c.capabilities)
+		}
+	}
+}
+
+func Test_HookContext_Fatal(t *testing.T) {
+	cases := []struct {
+		capabilities []string
+		expected     string
+	}{
+		{[]string{"side-band-64k"}, string(pktline("\x03error: declined\n"))},
+		{[]string{"side-band"}, string(pktline("\x03error: declined\n"))},
+		{[]string{}, string(pktline("ERR declined"))},
+	}
+
+	for _, c := range cases {
+		output := &bytes.Buffer{}
+		h := &HookContext{w: output, capabilities: c.capabilities}
+
+		if err := h.Fatal("declined"); err != nil {
+			t.Fatal(err)
+		}
+
+		if output.String() != c.expected {
+			t.Errorf("%v: expected %q but got %q", c.capabilities, c.expected, output.String())
+		}
+	}
+}
+
+func Test_HookContext_Writeln_flushes(t *testing.T) {
+	res := httptest.NewRecorder()
+	h := &HookContext{w: res, capabilities: []string{"side-band-64k"}}
+
+	if err := h.Writeln("building"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !res.Flushed {
+		t.Error("expected progress to be flushed to the client as soon as it is written")
+	}
+}
@@ -0,0 +1,170 @@
+package gittp
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NonceStatus says whether the nonce in a push certificate is one the server handed out, named after git's GIT_PUSH_CERT_NONCE_STATUS values
+type NonceStatus string
+
+const (
+	// NonceUnsolicited means the certificate has a nonce but the server did not ask for one
+	NonceUnsolicited NonceStatus = "UNSOLICITED"
+	// NonceMissing means the server asked for a nonce but the certificate does not have one
+	NonceMissing NonceStatus = "MISSING"
+	// NonceBad means the nonce was not handed out by the server
+	NonceBad NonceStatus = "BAD"
+	// NonceOK means the nonce was handed out by the server within ServerConfig.PushCertNonceSlop
+	NonceOK NonceStatus = "OK"
+	// NonceSlop means the nonce was handed out by the server, but longer ago than ServerConfig.PushCertNonceSlop allows
+	NonceSlop NonceStatus = "SLOP"
+)
+
+// PushCertificate is the signed statement a client sends with git push --signed, vouching for the ref updates in the push
+type PushCertificate struct {
+	// Raw is the certificate as the client sent it, signature included
+	Raw string
+	// Version is the certificate format version
+	Version string
+	// Pusher is the identity of the key that signed the certificate, with a timestamp, ie "A U Thor <author@example.com> 1500000000 +0000"
+	Pusher string
+	// Pushee is the URL the client pushed to
+	Pushee string
+	// Nonce is the nonce the server handed out, that the client signed
+	Nonce string
+	// NonceStatus says whether Nonce is one the server handed out
+	NonceStatus NonceStatus
+	// PushOptions are the push options the client signed
+	PushOptions []string
+	// Signature is the detached GPG or SSH signature over the rest of the certificate
+	Signature string
+	// Verified is true when Signature is good and made by a key in ServerConfig.Keyring
+	Verified bool
+	// Signer names who signed the certificate, the user id of a GPG key or the principal of an SSH key, when the signature is verified
+	Signer string
+	// Key is the fingerprint of the key that signed the certificate, when the signature is verified
+	Key     string
+	payload string
+	updates []RefUpdate
+}
+
+// parsePushCert splits a push certificate into its headers, commands and signature
+func parsePushCert(raw string) *PushCertificate {
+	cert := &PushCertificate{Raw: raw, payload: raw}
+
+	if start := signatureStart(raw); start >= 0 {
+		cert.payload, cert.Signature = raw[:start], raw[start:]
+	}
+
+	headers, commands := cert.payload, ""
+	if end := strings.Index(cert.payload, "\n\n"); end >= 0 {
+		headers, commands = cert.payload[:end+1], cert.payload[end+2:]
+	}
+
+	for _, line := range strings.Split(headers, "\n") {
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "certificate":
+			cert.Version = strings.TrimPrefix(fields[1], "version ")
+		case "pusher":
+			cert.Pusher = fields[1]
+		case "pushee":
+			cert.Pushee = fields[1]
+		case "nonce":
+			cert.Nonce = fields[1]
+		case "push-option":
+			cert.PushOptions = append(cert.PushOptions, fields[1])
+		}
+	}
+
+	for _, line := range strings.SplitAfter(commands, "\n") {
+		if update, ok := parseCommand(line); ok {
+			cert.updates = append(cert.updates, update)
+		}
+	}
+
+	return cert
+}
+
+// signatureStart finds where the signature starts in a signed buffer, the last line beginning a GPG or SSH signature
+func signatureStart(signed string) int {
+	start := -1
+	for _, marker := range []string{"-----BEGIN PGP SIGNATURE-----", "-----BEGIN SSH SIGNATURE-----"} {
+		if i := strings.LastIndex(signed, marker); i > start && (i == 0 || signed[i-1] == '\n') {
+			start = i
+		}
+	}
+
+	return start
+}
+
+// pushCertNonce makes the nonce git-receive-pack advertises for a repository at a point in time, so that nonces can be checked without keeping track of the ones handed out
+func pushCertNonce(seed, fullRepoPath string, stamp int64) string {
+	mac := hmac.New(sha1.New, []byte(fmt.Sprintf("%s:%d", fullRepoPath, stamp)))
+	mac.Write([]byte(seed))
+	return fmt.Sprintf("%d-%s", stamp, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// checkNonce checks that nonce was handed out for the repository, the same way git-receive-pack does for stateless connections
+func checkNonce(seed, fullRepoPath, nonce string, slop time.Duration, now time.Time) NonceStatus {
+	switch {
+	case seed == "":
+		return NonceUnsolicited
+	case nonce == "":
+		return NonceMissing
+	}
+
+	dash := strings.Index(nonce, "-")
+	if dash <= 0 {
+		return NonceBad
+	}
+
+	stamp, err := strconv.ParseInt(nonce[:dash], 10, 64)
+	if err != nil || !hmac.Equal([]byte(pushCertNonce(seed, fullRepoPath, stamp)), []byte(nonce)) {
+		return NonceBad
+	}
+
+	age := now.Sub(time.Unix(stamp, 0))
+	if age < 0 {
+		age = -age
+	}
+
+	if age.Truncate(time.Second) <= slop {
+		return NonceOK
+	}
+
+	return NonceSlop
+}
+
+// verifyPushCert parses the push certificate of a signed push, checking its nonce and verifying its signature against the keyring
+func (g *gitHTTPServer) verifyPushCert(ctx handlerContext) *PushCertificate {
+	cert := parsePushCert(ctx.PushCert)
+	cert.NonceStatus = checkNonce(g.PushCertNonceSeed, ctx.FullRepoPath, cert.Nonce, g.PushCertNonceSlop, time.Now())
+
+	if g.Keyring == nil || cert.Signature == "" {
+		return cert
+	}
+
+	signer, key, err := g.Keyring.Verify(ctx.Context, []byte(cert.payload), []byte(cert.Signature))
+	if err != nil {
+		if g.Debug {
+			log.Println("could not verify push certificate", err)
+		}
+
+		return cert
+	}
+
+	cert.Verified, cert.Signer, cert.Key = true, signer, key
+	return cert
+}
@@ -0,0 +1,170 @@
+package gittp
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPushCert = "certificate version 0.1\n" +
+	"pusher A U Thor <author@example.com> 1500000000 +0000\n" +
+	"pushee http://example.com/adam/repo.git\n" +
+	"nonce 1500000000-0123456789abcdef0123456789abcdef01234567\n" +
+	"push-option ci.skip\n" +
+	"\n" +
+	"0000000000000000000000000000000000000000 68839ad5d8bedf1147c214e4897ca6ad8afbfecc refs/heads/master\n" +
+	"68839ad5d8bedf1147c214e4897ca6ad8afbfecc 1d2f3b8a1c6e0b5a7f4e9d8c7b6a594837261504 refs/heads/feature\n"
+
+const testSignature = "-----BEGIN SSH SIGNATURE-----\nU1NIU0lH\n-----END SSH SIGNATURE-----\n"
+
+func Test_newPacketHeader_pushCert(t *testing.T) {
+	packData := string(pktline("push-cert\x00report-status side-band-64k agent=git/2.39.5\n"))
+	for _, line := range strings.SplitAfter(testPushCert+testSignature, "\n") {
+		if line != "" {
+			packData += string(pktline(line))
+		}
+	}
+	packData += string(pktline("push-cert-end\n")) + "0000"
+
+	actual := newPacketHeader([]byte(packData))
+
+	if actual.PushCert != testPushCert+testSignature {
+		t.Errorf("expected the push certificate to be kept as it was sent but got %q", actual.PushCert)
+	}
+
+	if actual.Agent != "git/2.39.5" || !hasCapability(actual.Capabilities, "report-status") {
+		t.Errorf("expected capabilities from the push-cert line but got %v %s", actual.Capabilities, actual.Agent)
+	}
+
+	if len(actual.Updates) != 2 || actual.Branch != "refs/heads/master" || actual.Updates[1].Ref != "refs/heads/feature" {
+		t.Errorf("expected the commands from the push certificate but got %+v", actual.Updates)
+	}
+}
+
+func Test_parsePushCert(t *testing.T) {
+	cert := parsePushCert(testPushCert + testSignature)
+
+	expected := &PushCertificate{
+		Raw:         testPushCert + testSignature,
+		Version:     "0.1",
+		Pusher:      "A U Thor <author@example.com> 1500000000 +0000",
+		Pushee:      "http://example.com/adam/repo.git",
+		Nonce:       "1500000000-0123456789abcdef0123456789abcdef01234567",
+		PushOptions: []string{"ci.skip"},
+		Signature:   testSignature,
+		payload:     testPushCert,
+		updates: []RefUpdate{
+			{Old: zeroHash, New: "68839ad5d8bedf1147c214e4897ca6ad8afbfecc", Ref: "refs/heads/master"},
+			{Old: "68839ad5d8bedf1147c214e4897ca6ad8afbfecc", New: "1d2f3b8a1c6e0b5a7f4e9d8c7b6a594837261504", Ref: "refs/heads/feature"},
+		},
+	}
+
+	if !reflect.DeepEqual(cert, expected) {
+		t.Errorf("expected:\n%+v\nactual:\n%+v", expected, cert)
+	}
+}
+
+func Test_checkNonce(t *testing.T) {
+	now := time.Unix(1500000100, 0)
+	repo := "/repositories/adam/repo.git"
+
+	cases := []struct {
+		seed, nonce string
+		expected    NonceStatus
+	}{
+		{"", pushCertNonce("seed", repo, 1500000100), NonceUnsolicited},
+		{"seed", "", NonceMissing},
+		{"seed", pushCertNonce("seed", repo, 1500000100), NonceOK},
+		{"seed", pushCertNonce("seed", repo, 1500000050), NonceOK},
+		{"seed", pushCertNonce("seed", repo, 1500000000), NonceSlop},
+		{"seed", pushCertNonce("other seed", repo, 1500000100), NonceBad},
+		{"seed", pushCertNonce("seed", "/repositories/adam/other.git", 1500000100), NonceBad},
+		{"seed", "not a nonce", NonceBad},
+	}
+
+	for _, c := range cases {
+		if actual := checkNonce(c.seed, repo, c.nonce, time.Minute, now); actual != c.expected {
+			t.Errorf("%q %q: expected %s but got %s", c.seed, c.nonce, c.expected, actual)
+		}
+	}
+}
+
+func Test_checkNonce_receivePack(t *testing.T) {
+	repo, _ := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	handler, err := NewGitServer(ServerConfig{Path: filepath.Dir(repo), PushCertNonceSeed: "seed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest("GET", "/repo.git/info/refs?service=git-receive-pack", nil))
+
+	// git-receive-pack hands out the nonce with the push-cert capability
+	match := regexp.MustCompile(`push-cert=([^ \n\x00]+)`).FindStringSubmatch(res.Body.String())
+	if match == nil {
+		t.Fatalf("expected a push-cert nonce to be advertised - actual %q", res.Body.String())
+	}
+
+	fullRepoPath, _ := filepath.Abs(repo)
+	if actual := checkNonce("seed", fullRepoPath, match[1], time.Minute, time.Now()); actual != NonceOK {
+		t.Errorf("expected the nonce git-receive-pack advertised, %s, to check out but got %s", match[1], actual)
+	}
+}
+
+func Test_Keyring_Verify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gittp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, other := filepath.Join(dir, "key"), filepath.Join(dir, "other")
+	for _, k := range []string{key, other} {
+		if err := exec.Command("ssh-keygen", "-q", "-t", "ed25519", "-N", "", "-f", k).Run(); err != nil {
+			t.Skip("ssh-keygen is needed to sign", err)
+		}
+	}
+
+	public, _ := ioutil.ReadFile(key + ".pub")
+	allowed := filepath.Join(dir, "allowed_signers")
+	ioutil.WriteFile(allowed, []byte("adam@example.com "+string(public)), 0644)
+
+	sign := func(key string) []byte {
+		cmd := exec.Command("ssh-keygen", "-Y", "sign", "-f", key, "-n", "git")
+		cmd.Stdin = strings.NewReader(testPushCert)
+		signature, err := cmd.Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+
+	keyring := &Keyring{AllowedSigners: allowed}
+
+	signer, fingerprint, err := keyring.Verify(context.Background(), []byte(testPushCert), sign(key))
+	if err != nil || signer != "adam@example.com" || !strings.HasPrefix(fingerprint, "SHA256:") {
+		t.Errorf("expected a good signature by adam@example.com but got %q %q %v", signer, fingerprint, err)
+	}
+
+	if _, _, err := keyring.Verify(context.Background(), []byte(testPushCert+"tampered"), sign(key)); err == nil {
+		t.Error("expected a signature over different content to fail")
+	}
+
+	if _, _, err := keyring.Verify(context.Background(), []byte(testPushCert), sign(other)); err == nil {
+		t.Error("expected a signature by a key outside of the keyring to fail")
+	}
+
+	if _, _, err := keyring.Verify(context.Background(), []byte(testPushCert), []byte("not a signature")); err != errUnknownSignatureFormat {
+		t.Errorf("expected %v but got %v", errUnknownSignatureFormat, err)
+	}
+}
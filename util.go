@@ -2,11 +2,14 @@ package gittp
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -17,6 +20,8 @@ var (
 	errCouldNotCreateRepo = errors.New("Could not create repository")
 	errCouldNotGetArchive = errors.New("Could not get an archive of the pushed refs")
 	errNotAGitRequest     = errors.New("requested url did not come from a git client")
+	errInvalidRepoName    = errors.New("invalid repository name")
+	errMalformedPktLine   = errors.New("malformed pkt-line")
 	null                  = []byte("\x00")
 )
 
@@ -27,53 +32,238 @@ type packetHeader struct {
 	Branch       string
 	Agent        string
 	Capabilities []string
+	Updates      []RefUpdate
+	// PushCert is the push certificate of a signed push, from its first line up to but not including push-cert-end
+	PushCert string
+	// PushOptions are the push options sent after the command list, when the client asked for the push-options capability
+	PushOptions []string
 }
 
 func newPacketHeader(packHeader []byte) packetHeader {
-	if len(packHeader) <= 4 {
-		return packetHeader{}
+	header := packetHeader{}
+	r := bytes.NewReader(packHeader)
+
+	var pushCert *bytes.Buffer
+	for first := true; ; first = false {
+		_, payload, err := readPktLine(r)
+		if err != nil || payload == nil {
+			break
+		}
+
+		line := string(payload)
+
+		if first {
+			splits := strings.SplitN(line, "\x00", 2)
+			line = splits[0]
+
+			if len(splits) > 1 {
+				header.Capabilities, header.Agent = parseCapabilities(splits[1])
+			}
+		}
+
+		// a signed push sends its commands inside of a push certificate
+		switch {
+		case first && strings.TrimSuffix(line, "\n") == "push-cert":
+			pushCert = &bytes.Buffer{}
+			continue
+		case pushCert != nil && line == "push-cert-end\n":
+			header.PushCert = pushCert.String()
+			pushCert = nil
+			continue
+		case pushCert != nil:
+			pushCert.WriteString(line)
+			continue
+		}
+
+		if update, ok := parseCommand(line); ok {
+			header.Updates = append(header.Updates, update)
+		}
 	}
 
-	splits := bytes.Split(packHeader[4:], null)
-	pushInfo := strings.Split(string(splits[0]), " ")
-	capabilities := strings.Split(string(splits[1]), " ")
-	capLen := len(capabilities) - 1
+	if header.PushCert != "" {
+		header.Updates = parsePushCert(header.PushCert).updates
+	}
 
-	return packetHeader{
-		Last:         pushInfo[0],
-		Head:         pushInfo[1],
-		Branch:       pushInfo[2],
-		Capabilities: capabilities[:capLen],
-		Agent:        strings.TrimPrefix(strings.TrimSuffix(capabilities[capLen], "0000"), "agent="),
+	if len(header.Updates) > 0 {
+		first := header.Updates[0]
+		header.Last, header.Head, header.Branch = first.Old, first.New, first.Ref
 	}
+
+	return header
 }
 
-// TODO needs tests
-func readPackInfo(packetData io.Reader) ([]byte, error) {
-	packetLengthBytes := make([]byte, 4)
-	_, err := io.ReadFull(packetData, packetLengthBytes)
-	if err == io.EOF {
-		return []byte{}, nil
-	} else if err != nil {
-		return []byte{}, errCouldNotReadReqBody
+// parseCommand parses a single "<old> <new> <ref>" command
+func parseCommand(line string) (RefUpdate, bool) {
+	pushInfo := strings.Split(strings.TrimSuffix(line, "\n"), " ")
+	if len(pushInfo) != 3 {
+		return RefUpdate{}, false
+	}
+
+	return RefUpdate{
+		Old: pushInfo[0],
+		New: pushInfo[1],
+		Ref: pushInfo[2],
+	}, true
+}
+
+// parsePushOptions parses the list of push options that follows the command list
+func parsePushOptions(options []byte) []string {
+	pushOptions := []string{}
+	r := bytes.NewReader(options)
+
+	for {
+		_, payload, err := readPktLine(r)
+		if err != nil || payload == nil {
+			return pushOptions
+		}
+
+		pushOptions = append(pushOptions, strings.TrimSuffix(string(payload), "\n"))
+	}
+}
+
+// gitConfigEnv passes configuration to git through the environment as key, value pairs
+func gitConfigEnv(pairs ...string) []string {
+	env := []string{fmt.Sprintf("GIT_CONFIG_COUNT=%d", len(pairs)/2)}
+	for i := 0; i+1 < len(pairs); i += 2 {
+		env = append(env, fmt.Sprintf("GIT_CONFIG_KEY_%d=%s", i/2, pairs[i]), fmt.Sprintf("GIT_CONFIG_VALUE_%d=%s", i/2, pairs[i+1]))
+	}
+
+	return env
+}
+
+// parseCommandRequest finds the command a protocol v2 request is running
+func parseCommandRequest(request []byte) string {
+	_, payload, err := readPktLine(bytes.NewReader(request))
+	if err != nil {
+		return ""
+	}
+
+	line := strings.TrimSuffix(string(payload), "\n")
+	if !strings.HasPrefix(line, "command=") {
+		return ""
+	}
+
+	return strings.TrimPrefix(line, "command=")
+}
+
+// uploadRequest holds what a fetch asked git-upload-pack for
+type uploadRequest struct {
+	Wants       []string
+	WantRefs    []string
+	Shallow     []string
+	Depth       int
+	DeepenSince int64
+	DeepenNot   []string
+	// Capabilities are the capabilities the client asked for, which protocol v0 and v1 clients send with their first want
+	Capabilities []string
+}
+
+// parseUploadRequest reads the wants and shallow info of an upload-pack request, from either a protocol v0/v1 want list or the arguments of a protocol v2 fetch command
+func parseUploadRequest(request []byte) uploadRequest {
+	upload := uploadRequest{}
+	r := bytes.NewReader(request)
+
+	for {
+		_, payload, err := readPktLine(r)
+		if err != nil || payload == nil {
+			break
+		}
+
+		fields := strings.Fields(strings.SplitN(string(payload), "\x00", 2)[0])
+
+		// protocol v2 always sends the packfile over side-band-64k
+		if len(fields) == 1 && fields[0] == "command=fetch" {
+			upload.Capabilities = []string{"side-band-64k"}
+		}
+
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "want":
+			if len(upload.Wants) == 0 && len(fields) > 2 {
+				upload.Capabilities, _ = parseCapabilities(strings.Join(fields[2:], " "))
+			}
+			upload.Wants = append(upload.Wants, fields[1])
+		case "want-ref":
+			upload.WantRefs = append(upload.WantRefs, fields[1])
+		case "shallow":
+			upload.Shallow = append(upload.Shallow, fields[1])
+		case "deepen":
+			upload.Depth, _ = strconv.Atoi(fields[1])
+		case "deepen-since":
+			upload.DeepenSince, _ = strconv.ParseInt(fields[1], 10, 64)
+		case "deepen-not":
+			upload.DeepenNot = append(upload.DeepenNot, fields[1])
+		}
 	}
 
-	var packetLength int64
-	if packetLength, err = strconv.ParseInt(string(packetLengthBytes), 16, 32); err != nil {
-		return nil, err
+	return upload
+}
+
+func parseCapabilities(capList string) (capabilities []string, agent string) {
+	for _, capability := range strings.Fields(capList) {
+		if strings.HasPrefix(capability, "agent=") {
+			agent = strings.TrimPrefix(capability, "agent=")
+		} else {
+			capabilities = append(capabilities, capability)
+		}
+	}
+
+	return
+}
+
+// readPktLine reads a single pkt-line from r. raw holds the bytes as they were read, length prefix included, and payload is nil when a flush-pkt is read
+func readPktLine(r io.Reader) (raw []byte, payload []byte, err error) {
+	raw = make([]byte, 4)
+	if _, err = io.ReadFull(r, raw); err != nil {
+		return nil, nil, err
+	}
+
+	packetLength, err := strconv.ParseInt(string(raw), 16, 32)
+	if err != nil {
+		return nil, nil, errMalformedPktLine
 	}
 
-	// someone just sent a pkt-flush only
-	if packetLength == 0 {
-		return packetLengthBytes, nil
+	switch {
+	case packetLength == 0:
+		return raw, nil, nil
+	case packetLength <= 2:
+		// delim-pkt and response-end-pkt carry no payload
+		return raw, []byte{}, nil
+	case packetLength < 4:
+		return nil, nil, errMalformedPktLine
 	}
 
-	rawHeader := make([]byte, packetLength)
-	if _, err := io.ReadFull(packetData, rawHeader); err != nil {
-		return []byte{}, fmt.Errorf("Could not read %v length\n%v", packetLength, errCouldNotReadReqBody)
+	payload = make([]byte, packetLength-4)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return nil, nil, fmt.Errorf("Could not read %v length\n%v", packetLength, errCouldNotReadReqBody)
 	}
 
-	return append(packetLengthBytes, rawHeader...), nil
+	return append(raw, payload...), payload, nil
+}
+
+// readPackInfo reads the command list at the front of a request body, up to and including the terminating flush-pkt
+func readPackInfo(packetData io.Reader) ([]byte, error) {
+	packInfo := []byte{}
+
+	for {
+		raw, payload, err := readPktLine(packetData)
+		if err == io.EOF && len(packInfo) == 0 {
+			return packInfo, nil
+		} else if err == errMalformedPktLine {
+			return nil, err
+		} else if err != nil {
+			return []byte{}, errCouldNotReadReqBody
+		}
+
+		packInfo = append(packInfo, raw...)
+
+		if payload == nil {
+			return packInfo, nil
+		}
+	}
 }
 
 // TODO needs tests
@@ -105,20 +295,35 @@ func parseRepoName(requestPath string) (string, error) {
 	return strings.TrimPrefix(path, "/"), nil
 }
 
-func gitArchive(fullRepoPath, hash string) ([]byte, error) {
-	cmd := exec.Command("git", "archive", hash)
-	cmd.Dir = fullRepoPath
-	cmd.Stderr = os.Stdout
+// cleanRepoName normalizes a repository name taken from a request path, refusing absolute names and names with .. in them so they cannot reach outside of the repositories directory
+func cleanRepoName(name string) (string, bool) {
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", false
+		}
+	}
 
-	tarArchive, err := cmd.Output()
-	if err != nil {
-		return nil, errCouldNotGetArchive
+	name = path.Clean(name)
+	if name == "." || path.IsAbs(name) {
+		return "", false
 	}
 
-	return tarArchive, nil
+	return name, true
 }
 
-func runCmd(pack string, repoPath string, input io.Reader, output io.Writer, advertise bool) error {
+// repoPathWithin joins a cleaned repository name to the repositories directory, making sure the result is still inside of it
+func repoPathWithin(repoPath, repoName string) (string, bool) {
+	fullRepoPath := filepath.Join(repoPath, repoName)
+
+	rel, err := filepath.Rel(filepath.Clean(repoPath), fullRepoPath)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return fullRepoPath, true
+}
+
+func runCmd(ctx context.Context, pack string, repoPath string, input io.Reader, output io.Writer, advertise bool, gitProtocol string, env ...string) error {
 	args := []string{"--stateless-rpc"}
 
 	if advertise {
@@ -127,12 +332,17 @@ func runCmd(pack string, repoPath string, input io.Reader, output io.Writer, adv
 
 	args = append(args, repoPath)
 
-	cmd := exec.Command(string(pack), args...)
+	cmd := exec.CommandContext(ctx, string(pack), args...)
 
 	cmd.Dir = repoPath
 	cmd.Stdin = input
 	cmd.Stdout = output
 
+	cmd.Env = append(os.Environ(), env...)
+	if gitProtocol != "" {
+		cmd.Env = append(cmd.Env, "GIT_PROTOCOL="+gitProtocol)
+	}
+
 	return cmd.Run()
 }
 
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"net/url"
+	"reflect"
 	"testing"
 )
 
@@ -35,6 +36,31 @@ func Test_parseRepoName(t *testing.T) {
 
 }
 
+func Test_cleanRepoName(t *testing.T) {
+	testCases := map[string]string{
+		"adam/project.git":         "adam/project.git",
+		"adam//project.git/":       "adam/project.git",
+		"adam/./project.git":       "adam/project.git",
+		"team/../secret.git":       "",
+		"../secret.git":            "",
+		"team/x/../../../etc":      "",
+		"/etc/secret.git":          "",
+		".":                        "",
+		"":                         "",
+	}
+
+	for input, expected := range testCases {
+		actual, ok := cleanRepoName(input)
+		if ok != (expected != "") || actual != expected {
+			t.Errorf("%q expected %q - actual %q %v", input, expected, actual, ok)
+		}
+	}
+
+	if _, ok := repoPathWithin("/srv/repositories", "adam/project.git"); !ok {
+		t.Error("expected a repository under the repositories directory to be allowed")
+	}
+}
+
 func Test_pktline(t *testing.T) {
 	cases := map[string]string{
 		"000fHello world":   "Hello world",
@@ -67,7 +93,7 @@ func Test_encode(t *testing.T) {
 
 func Test_newPacketHeader(t *testing.T) {
 	// need to get some git-receive-pack data to test with
-	packData := []byte("00940000000000000000000000000000000000000000 68839ad5d8bedf1147c214e4897ca6ad8afbfecc refs/heads/master\x00report-status side-band-64k agent=git/2.8.30000")
+	packData := []byte("00930000000000000000000000000000000000000000 68839ad5d8bedf1147c214e4897ca6ad8afbfecc refs/heads/master\x00report-status side-band-64k agent=git/2.8.30000")
 
 	actual := newPacketHeader(packData)
 	if actual.Agent != "git/2.8.3" {
@@ -86,3 +112,105 @@ func Test_newPacketHeader(t *testing.T) {
 		t.Error(actual.Head)
 	}
 }
+
+func Test_newPacketHeader_multipleRefs(t *testing.T) {
+	packData := []byte("00950000000000000000000000000000000000000000 68839ad5d8bedf1147c214e4897ca6ad8afbfecc refs/heads/master\x00 report-status side-band-64k agent=git/2.8.3\n" +
+		"006968839ad5d8bedf1147c214e4897ca6ad8afbfecc 1d2f3b8a1c6e0b5a7f4e9d8c7b6a594837261504 refs/heads/feature\n" +
+		"00631d2f3b8a1c6e0b5a7f4e9d8c7b6a594837261504 0000000000000000000000000000000000000000 refs/tags/v1\n" +
+		"0000")
+
+	actual := newPacketHeader(packData)
+
+	expected := []RefUpdate{
+		{Old: "0000000000000000000000000000000000000000", New: "68839ad5d8bedf1147c214e4897ca6ad8afbfecc", Ref: "refs/heads/master"},
+		{Old: "68839ad5d8bedf1147c214e4897ca6ad8afbfecc", New: "1d2f3b8a1c6e0b5a7f4e9d8c7b6a594837261504", Ref: "refs/heads/feature"},
+		{Old: "1d2f3b8a1c6e0b5a7f4e9d8c7b6a594837261504", New: "0000000000000000000000000000000000000000", Ref: "refs/tags/v1"},
+	}
+
+	if len(actual.Updates) != len(expected) {
+		t.Fatalf("expected %d updates - actual %d", len(expected), len(actual.Updates))
+	}
+
+	for i, update := range actual.Updates {
+		if update != expected[i] {
+			t.Errorf("expected:\n%v\nactual:\n%v\n", expected[i], update)
+		}
+	}
+
+	if actual.Branch != "refs/heads/master" {
+		t.Error(actual.Branch)
+	}
+
+	if actual.Agent != "git/2.8.3" {
+		t.Error(actual.Agent)
+	}
+
+	if len(actual.Capabilities) != 2 || actual.Capabilities[0] != "report-status" || actual.Capabilities[1] != "side-band-64k" {
+		t.Error(actual.Capabilities)
+	}
+}
+
+func Test_readPackInfo(t *testing.T) {
+	commands := "00680000000000000000000000000000000000000000 68839ad5d8bedf1147c214e4897ca6ad8afbfecc refs/heads/master\n0000"
+	body := bytes.NewBufferString(commands + "PACK....")
+
+	actual, err := readPackInfo(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(actual) != commands {
+		t.Errorf("expected:\n%s\nactual:\n%s\n", commands, actual)
+	}
+
+	if body.String() != "PACK...." {
+		t.Errorf("expected pack data to be left unread, actual %q", body.String())
+	}
+}
+
+func Test_parseCommandRequest(t *testing.T) {
+	testCases := map[string]string{
+		"0014command=ls-refs\n0014agent=git/2.39.50001000bpeel0000": "ls-refs",
+		"0012command=fetch\n0001000ddone\n0000":                     "fetch",
+		"0032want 68839ad5d8bedf1147c214e4897ca6ad8afbfecc\n0000":   "",
+		"": "",
+	}
+
+	for request, expected := range testCases {
+		if actual := parseCommandRequest([]byte(request)); actual != expected {
+			t.Errorf("expected %q - actual %q", expected, actual)
+		}
+	}
+}
+
+func Test_parseUploadRequest(t *testing.T) {
+	oid := "68839ad5d8bedf1147c214e4897ca6ad8afbfecc"
+	shallow := "cd5d3a04c6e4a1ff7b2f47b11f3bd1f8cb7ac7c3"
+
+	v0 := string(pktline("want "+oid+" multi_ack side-band-64k agent=git/2.39.5\n")) +
+		string(pktline("shallow "+shallow+"\n")) +
+		string(pktline("deepen 3\n")) +
+		"0000"
+
+	v2 := string(pktline("command=fetch\n")) +
+		string(pktline("agent=git/2.39.5\n")) +
+		"0001" +
+		string(pktline("want "+oid+"\n")) +
+		string(pktline("want-ref refs/heads/master\n")) +
+		string(pktline("deepen-since 1500000000\n")) +
+		string(pktline("deepen-not refs/tags/v1\n")) +
+		string(pktline("done\n")) +
+		"0000"
+
+	testCases := map[string]uploadRequest{
+		v0: {Wants: []string{oid}, Shallow: []string{shallow}, Depth: 3, Capabilities: []string{"multi_ack", "side-band-64k"}},
+		v2: {Wants: []string{oid}, WantRefs: []string{"refs/heads/master"}, DeepenSince: 1500000000, DeepenNot: []string{"refs/tags/v1"}, Capabilities: []string{"side-band-64k"}},
+		"": {},
+	}
+
+	for request, expected := range testCases {
+		if actual := parseUploadRequest([]byte(request)); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v - actual %+v", expected, actual)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package gittp
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// PushEvent is the webhook event sent when refs are pushed
+	PushEvent = "push"
+
+	// how many commits are listed in a push payload, matching GitHub
+	maxWebhookCommits = 20
+	// how many deliveries are kept in the delivery log
+	maxWebhookDeliveries = 256
+)
+
+var errNoSuchDelivery = errors.New("no delivery with that id")
+
+// Webhook is an endpoint that is sent a JSON payload for events on matching repositories
+type Webhook struct {
+	// URL is where payloads are POSTed
+	URL string
+	// Secret signs each payload with HMAC-SHA256, sent as sha256=<hex digest> in the X-Hub-Signature-256 header. Payloads are not signed when it is empty
+	Secret string
+	// Events lists the events to deliver. All events are delivered when it is empty
+	Events []string
+	// Repositories lists globs, in path.Match syntax, of the repositories to deliver events for. Events for every repository are delivered when it is empty
+	Repositories []string
+}
+
+func (w Webhook) wants(event, repoName string) bool {
+	wantsEvent := len(w.Events) == 0
+	for _, e := range w.Events {
+		wantsEvent = wantsEvent || e == event
+	}
+
+	wantsRepo := len(w.Repositories) == 0
+	for _, glob := range w.Repositories {
+		matched, _ := path.Match(glob, repoName)
+		wantsRepo = wantsRepo || matched
+	}
+
+	return wantsEvent && wantsRepo
+}
+
+// WebhookDelivery is a record of a payload sent to a webhook
+type WebhookDelivery struct {
+	ID          string          `json:"id"`
+	URL         string          `json:"url"`
+	Event       string          `json:"event"`
+	Repository  string          `json:"repository"`
+	Payload     json.RawMessage `json:"payload"`
+	StatusCode  int             `json:"status_code"`
+	Error       string          `json:"error,omitempty"`
+	Redelivery  bool            `json:"redelivery"`
+	DeliveredAt time.Time       `json:"delivered_at"`
+	Duration    time.Duration   `json:"duration"`
+	webhook     Webhook
+}
+
+// Webhooks sends GitHub style push payloads to webhooks for every accepted push, and keeps a log of recent deliveries.
+//
+// Webhooks is also an http.Handler for the delivery log: GET / lists recent deliveries, GET /{id} returns a single delivery and POST /{id}/redeliver sends its payload again.
+type Webhooks struct {
+	hooks      []Webhook
+	client     *http.Client
+	mu         sync.Mutex
+	deliveries []*WebhookDelivery
+	// Debug enables logging of failed deliveries
+	Debug bool
+}
+
+// NewWebhooks creates a Webhooks that delivers to hooks
+func NewWebhooks(hooks ...Webhook) *Webhooks {
+	return &Webhooks{
+		hooks:  hooks,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// pushPayload is the body of a push event, following the shape of GitHub's push event
+type pushPayload struct {
+	Ref        string         `json:"ref"`
+	Before     string         `json:"before"`
+	After      string         `json:"after"`
+	Created    bool           `json:"created"`
+	Deleted    bool           `json:"deleted"`
+	Forced     bool           `json:"forced"`
+	Repository pushRepository `json:"repository"`
+	Pusher     pushPusher     `json:"pusher"`
+	HeadCommit *Commit        `json:"head_commit"`
+	Commits    []Commit       `json:"commits"`
+}
+
+type pushRepository struct {
+	Name     string `json:"name"`
+	FullName string `json:"full_name"`
+}
+
+type pushPusher struct {
+	Name string `json:"name"`
+}
+
+// newPushPayloads builds a push event for each ref update in a push that was accepted. Webhooks are delivered after the request is done, so git is not ran with the request's context.
+func newPushPayloads(h *HookContext) []pushPayload {
+	payloads := []pushPayload{}
+
+	pusher := "anonymous"
+	if h.Principal != nil {
+		pusher = h.Principal.Name
+	}
+
+	for _, update := range h.RefUpdates {
+		payload := pushPayload{
+			Ref:        update.Ref,
+			Before:     update.Old,
+			After:      update.New,
+			Created:    update.Type == CreateUpdate,
+			Deleted:    update.Type == DeleteUpdate,
+			Forced:     update.Type == ForceUpdate,
+			Repository: pushRepository{path.Base(h.Repository), h.Repository},
+			Pusher:     pushPusher{pusher},
+			Commits:    []Commit{},
+		}
+
+		if !payload.Deleted {
+			revisions := []string{update.Old + ".." + update.New}
+			if payload.Created {
+				revisions = []string{update.New, "--not", "--exclude=" + update.Ref, "--glob=refs/*"}
+			}
+
+			args := append([]string{"--reverse", fmt.Sprintf("--max-count=%d", maxWebhookCommits)}, revisions...)
+			if commits, err := gitLog(context.Background(), h.FullRepoPath, nil, args...); err == nil {
+				payload.Commits = commits
+			}
+
+			if head, err := gitLog(context.Background(), h.FullRepoPath, nil, "--max-count=1", update.New); err == nil && len(head) == 1 {
+				payload.HeadCommit = &head[0]
+			}
+		}
+
+		payloads = append(payloads, payload)
+	}
+
+	return payloads
+}
+
+// push delivers a push event for each ref update to every webhook interested in the repository
+func (w *Webhooks) push(h *HookContext) []WebhookDelivery {
+	deliveries := []WebhookDelivery{}
+
+	for _, payload := range newPushPayloads(h) {
+		raw, err := json.Marshal(payload)
+		if err != nil {
+			continue
+		}
+
+		for _, hook := range w.hooks {
+			if hook.wants(PushEvent, h.Repository) {
+				deliveries = append(deliveries, w.deliver(hook, PushEvent, h.Repository, raw, false))
+			}
+		}
+	}
+
+	return deliveries
+}
+
+func (w *Webhooks) deliver(hook Webhook, event, repoName string, payload []byte, redelivery bool) WebhookDelivery {
+	id, _ := newJobID()
+	delivery := &WebhookDelivery{
+		ID:          id,
+		URL:         hook.URL,
+		Event:       event,
+		Repository:  repoName,
+		Payload:     payload,
+		Redelivery:  redelivery,
+		DeliveredAt: time.Now().UTC(),
+		webhook:     hook,
+	}
+
+	if err := w.send(delivery); err != nil {
+		delivery.Error = err.Error()
+
+		if w.Debug {
+			log.Println("webhook delivery to", hook.URL, "failed", err)
+		}
+	}
+
+	delivery.Duration = time.Since(delivery.DeliveredAt)
+
+	w.mu.Lock()
+	w.deliveries = append(w.deliveries, delivery)
+	if len(w.deliveries) > maxWebhookDeliveries {
+		w.deliveries = w.deliveries[len(w.deliveries)-maxWebhookDeliveries:]
+	}
+	w.mu.Unlock()
+
+	return *delivery
+}
+
+func (w *Webhooks) send(delivery *WebhookDelivery) error {
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gittp")
+	req.Header.Set("X-Gittp-Event", delivery.Event)
+	req.Header.Set("X-Gittp-Delivery", delivery.ID)
+
+	if delivery.webhook.Secret != "" {
+		req.Header.Set("X-Hub-Signature-256", signPayload(delivery.webhook.Secret, delivery.Payload))
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	delivery.StatusCode = res.StatusCode
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", res.Status)
+	}
+
+	return nil
+}
+
+func signPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliveries returns the delivery log, oldest first
+func (w *Webhooks) Deliveries() []WebhookDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deliveries := make([]WebhookDelivery, len(w.deliveries))
+	for i, d := range w.deliveries {
+		deliveries[i] = *d
+	}
+
+	return deliveries
+}
+
+// Delivery returns a single delivery from the log
+func (w *Webhooks) Delivery(id string) (WebhookDelivery, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, d := range w.deliveries {
+		if d.ID == id {
+			return *d, nil
+		}
+	}
+
+	return WebhookDelivery{}, errNoSuchDelivery
+}
+
+// Redeliver sends the payload of a logged delivery to its webhook again, returning the new delivery
+func (w *Webhooks) Redeliver(id string) (WebhookDelivery, error) {
+	original, err := w.Delivery(id)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return w.deliver(original.webhook, original.Event, original.Repository, original.Payload, true), nil
+}
+
+func (w *Webhooks) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	var body interface{}
+	var err error
+
+	route := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+
+	switch {
+	case req.Method == "GET" && route[0] == "":
+		body = w.Deliveries()
+	case req.Method == "GET" && len(route) == 1:
+		body, err = w.Delivery(route[0])
+	case req.Method == "POST" && len(route) == 2 && route[1] == "redeliver":
+		body, err = w.Redeliver(route[0])
+	default:
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		res.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	res.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(res).Encode(body)
+}
@@ -0,0 +1,105 @@
+package gittp
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_Webhooks(t *testing.T) {
+	repo, commit := createTestRepo(t)
+	defer os.RemoveAll(filepath.Dir(repo))
+
+	type received struct {
+		event, signature string
+		payload          pushPayload
+	}
+
+	requests := make(chan received, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+
+		r := received{event: req.Header.Get("X-Gittp-Event"), signature: req.Header.Get("X-Hub-Signature-256")}
+		if r.signature != signPayload("secret", body) {
+			res.WriteHeader(http.StatusBadRequest)
+		}
+
+		json.Unmarshal(body, &r.payload)
+		requests <- r
+	}))
+	defer receiver.Close()
+
+	hooks := NewWebhooks(
+		Webhook{URL: receiver.URL, Secret: "secret", Repositories: []string{"team/*"}},
+		Webhook{URL: receiver.URL, Secret: "secret", Repositories: []string{"other/*"}},
+		Webhook{URL: receiver.URL, Secret: "secret", Events: []string{"release"}},
+	)
+
+	h := &HookContext{
+		Repository:   "team/repo.git",
+		FullRepoPath: repo,
+		Principal:    &Principal{Name: "adam"},
+		RefUpdates:   []RefUpdate{{Old: zeroHash, New: commit, Ref: "refs/heads/master", Type: CreateUpdate}},
+	}
+
+	deliveries := hooks.push(h)
+	if len(deliveries) != 1 {
+		t.Fatalf("expected 1 delivery but got %d", len(deliveries))
+	}
+
+	if deliveries[0].StatusCode != http.StatusOK || deliveries[0].Error != "" {
+		t.Errorf("expected a successful delivery but got %d %s", deliveries[0].StatusCode, deliveries[0].Error)
+	}
+
+	r := <-requests
+	if r.event != PushEvent {
+		t.Errorf("expected %s event but got %s", PushEvent, r.event)
+	}
+
+	p := r.payload
+	if p.Ref != "refs/heads/master" || p.After != commit || !p.Created || p.Deleted || p.Forced {
+		t.Errorf("unexpected ref update in payload %+v", p)
+	}
+
+	if p.Pusher.Name != "adam" || p.Repository.FullName != "team/repo.git" || p.Repository.Name != "repo.git" {
+		t.Errorf("unexpected pusher or repository in payload %+v", p)
+	}
+
+	if len(p.Commits) != 1 || p.Commits[0].Hash != commit || p.Commits[0].Message != "initial commit" || p.Commits[0].Author.Email != "gittp@example.com" {
+		t.Errorf("unexpected commits in payload %+v", p.Commits)
+	}
+
+	if p.HeadCommit == nil || p.HeadCommit.Hash != commit {
+		t.Errorf("expected head commit %s but got %+v", commit, p.HeadCommit)
+	}
+
+	res := httptest.NewRecorder()
+	hooks.ServeHTTP(res, httptest.NewRequest("POST", "/"+deliveries[0].ID+"/redeliver", nil))
+
+	var redelivery WebhookDelivery
+	if err := json.NewDecoder(res.Body).Decode(&redelivery); err != nil || !redelivery.Redelivery || redelivery.ID == deliveries[0].ID {
+		t.Errorf("expected a new redelivery but got %+v %v", redelivery, err)
+	}
+
+	if r := <-requests; r.payload.After != commit {
+		t.Errorf("expected the redelivered payload to match the original but got %+v", r.payload)
+	}
+
+	res = httptest.NewRecorder()
+	hooks.ServeHTTP(res, httptest.NewRequest("GET", "/", nil))
+
+	var log []WebhookDelivery
+	if err := json.NewDecoder(res.Body).Decode(&log); err != nil || len(log) != 2 {
+		t.Errorf("expected 2 deliveries in the log but got %d %v", len(log), err)
+	}
+
+	res = httptest.NewRecorder()
+	hooks.ServeHTTP(res, httptest.NewRequest("POST", "/missing/redeliver", nil))
+	if res.Code != http.StatusNotFound {
+		t.Errorf("expected 404 redelivering a missing delivery but got %d", res.Code)
+	}
+}